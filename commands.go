@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"datapushgateway/functions"
+)
+
+// checkConfig prints the problems found in the config file and returns the exit status.
+func checkConfig(configFile, dataDir, tagsFile string) int {
+	problems := functions.CheckConfig(configFile, dataDir, tagsFile)
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", configFile, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problem(s) found\n", configFile, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: OK\n", configFile)
+	return 0
+}
+
+// renderPayload renders a saved payload into outDir, optionally diffing the result against
+// compareDir, and returns the exit status.
+func renderPayload(configFile, payloadFile, outDir, compareDir, customer, instance, user string) int {
+	// Rendering never records revisions, so the Perforce settings are not needed
+	functions.SetStorageType(functions.StorageFilesystem)
+	if _, err := functions.LoadConfig(configFile); err != nil {
+		logger.Errorf("Error loading config file %s: %v", configFile, err)
+		return 1
+	}
+
+	changed, err := functions.RenderPayloadFile(payloadFile, outDir, customer, instance, user, logger)
+	if err != nil {
+		logger.Errorf("Error rendering %s: %v", payloadFile, err)
+		return 1
+	}
+	for _, path := range changed {
+		fmt.Println(path)
+	}
+	if compareDir == "" {
+		return 0
+	}
+
+	differs, err := functions.DiffOutput(os.Stdout, outDir, compareDir, customer)
+	if err != nil {
+		logger.Errorf("Error comparing with %s: %v", compareDir, err)
+		return 1
+	}
+	if !differs {
+		fmt.Printf("No differences from %s\n", compareDir)
+	}
+	return 0
+}
+
+// rerender rebuilds the customer's files from the kept payloads and returns the exit status.
+func rerender(store functions.VersionedStore, dataDir, customer, user string) int {
+	changed, revision, err := functions.Rerender(store, dataDir, customer, user, logger)
+	if err != nil {
+		logger.Errorf("Error rerendering customer %s: %v", customer, err)
+		return 1
+	}
+	for _, path := range changed {
+		fmt.Println(path)
+	}
+	switch {
+	case len(changed) == 0:
+		fmt.Println("No changes")
+	case revision != nil:
+		fmt.Printf("Committed %s\n", revision.ID)
+	}
+	return 0
+}
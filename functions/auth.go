@@ -1,25 +1,106 @@
 package functions
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"path"
 	"regexp"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/yaml.v2"
 )
 
-var usersPasswords = map[string][]byte{}
+// authState is the parsed contents of the auth file. It is replaced as a whole on reload.
+type authState struct {
+	usersPasswords map[string][]byte
+	// certUsers maps a client certificate subject (CN or SAN) to the identity it authenticates as.
+	certUsers map[string]string
+	// userAccess restricts which customers and instances a user may push data for.
+	// Users without an entry may push for any customer and instance.
+	userAccess map[string]UserAccess
+}
+
+var currentAuth atomic.Pointer[authState]
+
+// validName whitelists the characters allowed in customer and instance names.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ValidName reports whether name is a non-empty customer or instance name made of allowed
+// characters.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+func init() {
+	currentAuth.Store(&authState{})
+}
 
 type AuthFile struct {
-	Users map[string]string `yaml:"basic_auth_users"`
+	Users           map[string]string     `yaml:"basic_auth_users"`
+	ClientCertUsers map[string]string     `yaml:"client_cert_users"`
+	UserAccess      map[string]UserAccess `yaml:"user_access"`
+}
+
+// UserAccess lists the customers a user may push data for, and optionally glob patterns
+// restricting the instances within those customers.
+type UserAccess struct {
+	Customers []string `yaml:"customers"`
+	Instances []string `yaml:"instances"`
+}
+
+// Allows reports whether the access entry permits pushing data for customer and instance.
+func (ua UserAccess) Allows(customer, instance string) bool {
+	if !matchesAny(ua.Customers, customer) {
+		return false
+	}
+	if len(ua.Instances) == 0 {
+		return true
+	}
+	return matchesAny(ua.Instances, instance)
+}
+
+// matchesAny reports whether name matches any of the glob patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizeCustomer reports whether user may access data for customer, regardless of instance.
+func AuthorizeCustomer(user, customer string) bool {
+	access, restricted := currentAuth.Load().userAccess[user]
+	if !restricted {
+		return true
+	}
+	return matchesAny(access.Customers, customer)
+}
+
+// AuthorizeAdmin reports whether user may run administrative actions such as a reload, which
+// is only allowed to users without a user_access entry.
+func AuthorizeAdmin(user string) bool {
+	_, restricted := currentAuth.Load().userAccess[user]
+	return !restricted
+}
+
+// Authorize reports whether user may push data for customer and instance.
+func Authorize(user, customer, instance string) bool {
+	access, restricted := currentAuth.Load().userAccess[user]
+	if !restricted {
+		return true
+	}
+	return access.Allows(customer, instance)
 }
 
 func VerifyUserPass(username, password string) bool {
-	wantPass, hasUser := usersPasswords[username]
+	wantPass, hasUser := currentAuth.Load().usersPasswords[username]
 	if !hasUser {
 		return false
 	}
@@ -29,50 +110,141 @@ func VerifyUserPass(username, password string) bool {
 	return false
 }
 
+// ReadAuthFile parses and validates the auth file and makes it the active one.
 func ReadAuthFile(fname string) error {
+	state, err := parseAuthFile(fname)
+	if err != nil {
+		return err
+	}
+	currentAuth.Store(state)
+	return nil
+}
+
+func parseAuthFile(fname string) (*authState, error) {
 	yfile, err := os.ReadFile(fname)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("error reading auth file %s: %v", fname, err)
 	}
 
 	users := AuthFile{}
 	err = yaml.Unmarshal(yfile, &users)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("error parsing auth file %s: %v", fname, err)
 	}
 
+	state := &authState{
+		usersPasswords: make(map[string][]byte),
+		certUsers:      make(map[string]string),
+		userAccess:     make(map[string]UserAccess),
+	}
 	for k, v := range users.Users {
-		usersPasswords[k] = []byte(v)
+		if _, err := bcrypt.Cost([]byte(v)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt password for user %s in %s: %v", k, fname, err)
+		}
+		state.usersPasswords[k] = []byte(v)
 	}
-	return nil
+	for k, v := range users.ClientCertUsers {
+		state.certUsers[k] = v
+	}
+	for k, v := range users.UserAccess {
+		for _, pattern := range append(append([]string{}, v.Customers...), v.Instances...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q in user_access for %s: %v", pattern, k, err)
+			}
+		}
+		state.userAccess[k] = v
+	}
+	return state, nil
+}
+
+// VerifyClientCert maps a verified TLS client certificate to an identity from client_cert_users.
+// The certificate CN is checked first, then its DNS, email and URI SANs.
+func VerifyClientCert(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := state.VerifiedChains[0][0]
+	subjects := []string{leaf.Subject.CommonName}
+	subjects = append(subjects, leaf.DNSNames...)
+	subjects = append(subjects, leaf.EmailAddresses...)
+	for _, uri := range leaf.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	certUsers := currentAuth.Load().certUsers
+	for _, subject := range subjects {
+		if subject == "" {
+			continue
+		}
+		if user, ok := certUsers[subject]; ok {
+			return user, true
+		}
+	}
+	return "", false
 }
-func HandleHTTP(w http.ResponseWriter, req *http.Request, logger *logrus.Logger, dataDir string) (string, string, error) {
+
+// Authenticate returns the identity of the caller, accepting either a mapped client certificate
+// or valid basic auth credentials.
+func Authenticate(req *http.Request) (string, bool) {
+	if user, ok := VerifyClientCert(req.TLS); ok {
+		return user, true
+	}
+	user, pass, ok := req.BasicAuth()
+	if ok && VerifyUserPass(user, pass) {
+		return user, true
+	}
+	return "", false
+}
+
+// LoadClientCAs reads a PEM bundle of CA certificates used to verify client certificates.
+func LoadClientCAs(fname string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA file %s: %v", fname, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", fname)
+	}
+	return pool, nil
+}
+
+// HandleHTTP checks a /json/ request, answering it with an error if it is not acceptable.
+// It returns the customer, the instance and the authenticated user.
+func HandleHTTP(w http.ResponseWriter, req *http.Request, logger *logrus.Logger, dataDir string) (string, string, string, error) {
 	// Ensure that the request is a POST request
 	if req.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return "", "", fmt.Errorf("Method not allowed")
+		return "", "", "", fmt.Errorf("Method not allowed")
 	}
 
-	user, pass, ok := req.BasicAuth()
-	if !ok || !VerifyUserPass(user, pass) {
+	user, ok := Authenticate(req)
+	if !ok {
+		RecordAuthFailure("json")
 		w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return "", "", fmt.Errorf("Unauthorized")
+		return "", "", "", fmt.Errorf("Unauthorized")
 	}
 
+	logger.Debugf("Authenticated user: %s", user)
+
 	query := req.URL.Query()
 	customer := query.Get("customer")
 	instance := query.Get("instance")
 	if customer == "" || instance == "" {
 		http.Error(w, "Please specify customer and instance", http.StatusBadRequest)
-		return "", "", fmt.Errorf("Customer or Instance not specified")
+		return "", "", "", fmt.Errorf("Customer or Instance not specified")
 	}
 	// Whitelist check using regular expression
-	var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
 	if !validName.MatchString(customer) || !validName.MatchString(instance) {
 		http.Error(w, "Invalid characters in customer or instance name", http.StatusBadRequest)
-		return "", "", fmt.Errorf("Invalid characters detected")
+		return "", "", "", fmt.Errorf("Invalid characters detected")
+	}
+	if !Authorize(user, customer, instance) {
+		logger.Warnf("User %s is not authorized for customer: %s, instance: %s", user, customer, instance)
+		RecordAuthFailure("json")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", "", "", fmt.Errorf("Forbidden")
 	}
 	// All checks have passed
-	return customer, instance, nil
+	return customer, instance, user, nil
 }
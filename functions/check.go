@@ -0,0 +1,163 @@
+package functions
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// CheckConfig loads the config file the way the gateway does and reports problems that would
+// not stop it from starting but make it misbehave: duplicate outputs and tags, unknown
+// placeholders, paths outside the data directory and a missing Perforce setup. If tagsFile is
+// set, it lists the monitor tags clients send, one per line, and monitor_tags entries matching
+// none of them are reported as well. An empty result means the config is fine.
+func CheckConfig(configFile, dataDir, tagsFile string) []string {
+	var problems []string
+
+	config, err := decodeConfig(configFile)
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if config.Storage.Type == StorageP4 {
+		if _, err := os.Stat(config.ApplicationConfig.P4Config); err != nil {
+			problems = append(problems, fmt.Sprintf("P4CONFIG %s: %v", config.ApplicationConfig.P4Config, err))
+		}
+		if _, err := exec.LookPath(config.ApplicationConfig.P4Bin); err != nil {
+			problems = append(problems, fmt.Sprintf("p4bin %s: %v", config.ApplicationConfig.P4Bin, err))
+		}
+	}
+
+	sortConfig, err := LoadSortConfig(configFile)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+
+	var sentTags map[string]bool
+	if tagsFile != "" {
+		sentTags, err = readTagsFile(tagsFile)
+		if err != nil {
+			return append(problems, err.Error())
+		}
+	}
+	return append(problems, checkSortConfig(sortConfig, dataDir, sentTags)...)
+}
+
+// readTagsFile reads a list of monitor tags, one per line, ignoring blank lines and # comments.
+func readTagsFile(fname string) (map[string]bool, error) {
+	file, err := os.Open(fname)
+	if err != nil {
+		return nil, fmt.Errorf("error reading tags file: %v", err)
+	}
+	defer file.Close()
+
+	tags := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		tag := strings.TrimSpace(scanner.Text())
+		if tag != "" && !strings.HasPrefix(tag, "#") {
+			tags[tag] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading tags file: %v", err)
+	}
+	return tags, nil
+}
+
+func checkSortConfig(sortConfig *SortConfig, dataDir string, sentTags map[string]bool) []string {
+	var problems []string
+	report := func(entry string, fileConfig FileConfig, format string, args ...interface{}) {
+		name := filepath.ToSlash(filepath.Join(fileConfig.Directory, fileConfig.FileName))
+		problems = append(problems, fmt.Sprintf("%s (%s): %s", entry, name, fmt.Sprintf(format, args...)))
+	}
+
+	// outputs maps each file written to the entry writing it
+	outputs := make(map[string]string)
+	checkOutput := func(entry string, fileConfig FileConfig) {
+		if fileConfig.FileName == "" {
+			report(entry, fileConfig, "file_name is empty")
+		}
+		for _, value := range []string{fileConfig.FileName, fileConfig.Directory} {
+			if err := checkPlaceholders(value); err != nil {
+				report(entry, fileConfig, "%v", err)
+			}
+		}
+		if escapesCustomerDir(dataDir, fileConfig) {
+			report(entry, fileConfig, "path is outside the customer directory")
+		}
+
+		renderer, err := fileConfig.fileRenderer()
+		if err == nil {
+			output := filepath.Join(fileConfig.Directory, fileConfig.FileName+renderer.Extension())
+			if previous, ok := outputs[output]; ok {
+				report(entry, fileConfig, "writes the same file as %s", previous)
+			} else {
+				outputs[output] = entry
+			}
+		}
+	}
+
+	for index, fileConfig := range sortConfig.FileConfigs {
+		entry := fmt.Sprintf("file_configs[%d]", index)
+		checkOutput(entry, fileConfig)
+
+		if len(fileConfig.MonitorTags) == 0 {
+			report(entry, fileConfig, "has no monitor_tags")
+		}
+		// Tags match case-insensitively, so differently cased entries are duplicates too
+		seen := make(map[string]bool)
+		for i, tag := range fileConfig.MonitorTags {
+			key := strings.ToLower(tag)
+			if seen[key] {
+				report(entry, fileConfig, "monitor tag %q is listed more than once", tag)
+				continue
+			}
+			seen[key] = true
+			if sentTags != nil && !matchesSentTag(fileConfig.tagPatterns[i], sentTags) {
+				report(entry, fileConfig, "monitor tag %q does not match any tag sent by clients", tag)
+			}
+		}
+	}
+	if sortConfig.Unmatched != nil {
+		checkOutput("unmatched", *sortConfig.Unmatched)
+	}
+	return problems
+}
+
+// matchesSentTag reports whether any of the tags clients send matches the pattern.
+func matchesSentTag(pattern *regexp.Regexp, sentTags map[string]bool) bool {
+	for tag := range sentTags {
+		if pattern.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlaceholders reports unbalanced or unknown %PLACEHOLDER%s in value.
+func checkPlaceholders(value string) error {
+	parts := strings.Split(value, "%")
+	if len(parts)%2 == 0 {
+		return fmt.Errorf("unbalanced %% in %q", value)
+	}
+	for i := 1; i < len(parts); i += 2 {
+		if !contains(pathPlaceholders, parts[i]) {
+			return fmt.Errorf("unknown placeholder %%%s%% in %q (available: %%%s%%)", parts[i], value, strings.Join(pathPlaceholders, "%, %"))
+		}
+	}
+	return nil
+}
+
+// escapesCustomerDir reports whether the file config's path leaves the customer directory.
+func escapesCustomerDir(dataDir string, fileConfig FileConfig) bool {
+	customerDir := filepath.Join(dataDir, "customer")
+	path := filepath.Join(customerDir, fileConfig.Directory, fileConfig.FileName)
+	for _, placeholder := range pathPlaceholders {
+		path = strings.ReplaceAll(path, "%"+placeholder+"%", "placeholder")
+	}
+	rel, err := filepath.Rel(customerDir, path)
+	return err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -1,14 +1,17 @@
 package functions
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -16,37 +19,65 @@ import (
 
 // SortConfig represents the structure of the config.yaml file.
 type SortConfig struct {
-	FileConfigs []struct {
-		FileName    string   `yaml:"file_name"`
-		Directory   string   `yaml:"directory"`
-		MonitorTags []string `yaml:"monitor_tags"`
-	} `yaml:"file_configs"`
+	FileConfigs []FileConfig `yaml:"file_configs"`
+	// Unmatched, if set, collects the items whose tag matches no file config. Its
+	// monitor_tags are ignored.
+	Unmatched *FileConfig `yaml:"unmatched"`
+	// VolatileLines are regular expressions for lines (such as timestamps) that are ignored
+	// when deciding whether a file's content has changed.
+	VolatileLines []string `yaml:"volatile_lines"`
+	// SubmitDescription is a template for the description of each submit, see SubmitContext.
+	SubmitDescription string `yaml:"submit_description"`
+
+	volatile       []*regexp.Regexp
+	submitTemplate *template.Template
 }
 
-// CreateMarkdownFiles generates Markdown files based on the grouped data.
-func CreateMarkdownFiles(dataDir string, groupedData map[string][]string, sortConfig *SortConfig, logger *logrus.Logger, customer string, instance string) error {
-	// Create a map to store the directory for each file name
-	dirMap := make(map[string]string)
-	for _, fileConfig := range sortConfig.FileConfigs {
-		dirMap[fileConfig.FileName] = fileConfig.Directory
+// FileConfig describes one generated file and the monitor tags collected into it.
+type FileConfig struct {
+	FileName  string `yaml:"file_name"`
+	Directory string `yaml:"directory"`
+	// MonitorTags select the items collected into the file, and their order. Entries may be
+	// literal tags, globs such as "p4 *" or regular expressions such as "re:^Autobot OS_.*".
+	MonitorTags []string `yaml:"monitor_tags"`
+	// Renderer selects the output format: markdown (default), html, json or text.
+	Renderer string `yaml:"renderer"`
+	// Template is a text/template, inline or the path of a template file, that replaces the
+	// renderer's layout. The renderer still decides the file extension.
+	Template string `yaml:"template"`
+
+	renderer    Renderer
+	tagPatterns []*regexp.Regexp
+}
+
+// fileRenderer returns the renderer for the file config, as resolved when the config was loaded.
+func (fc FileConfig) fileRenderer() (Renderer, error) {
+	if fc.renderer != nil {
+		return fc.renderer, nil
 	}
+	return lookupRenderer(fc.Renderer)
+}
+
+// CreateMarkdownFiles generates report files based on the grouped data, formatted by each
+// file config's renderer (Markdown unless configured otherwise).
+// Files whose content is unchanged apart from volatile lines are left alone. Every file
+// rendered or removed is returned, marked with whether it changed.
+func CreateMarkdownFiles(store VersionedStore, dataDir string, groupedData map[int][]Item, sortConfig *SortConfig, logger *logrus.Logger, customer string, instance string) ([]FileResult, error) {
+	var files []FileResult
+	pushTime := time.Now()
 
 	// Iterate over the FileConfigs in the correct order
-	for _, fileConfig := range sortConfig.FileConfigs {
+	for index, fileConfig := range sortConfig.FileConfigs {
 		fileName := fileConfig.FileName
-		directory := fileConfig.Directory
-
-		// Replace any occurrence of %INSTANCE% with the actual instance name
-		directory = strings.Replace(directory, "%INSTANCE%", instance, -1)
 
-		// Create the directory if it doesn't exist
-		dirPath := filepath.Join(dataDir, customer, directory)
+		// Create the directory if it doesn't exist; its placeholders are already substituted
+		dirPath := filepath.Join(dataDir, customer, fileConfig.Directory)
 		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
-			return fmt.Errorf("error creating directory %s: %v", dirPath, err)
+			return nil, fmt.Errorf("error creating directory %s: %v", dirPath, err)
 		}
 
-		// Get the items for the current file name and sort them based on the order specified in config.yaml
-		items := groupedData[fileName]
+		// Get the items for the current file config and sort them based on the order specified in config.yaml
+		items := groupedData[index]
 
 		// Skip creating the Markdown file if there are no items for this fileName
 		if len(items) == 0 {
@@ -55,84 +86,70 @@ func CreateMarkdownFiles(dataDir string, groupedData map[string][]string, sortCo
 		}
 
 		sort.SliceStable(items, func(i, j int) bool {
-			item1Data := make(map[string]interface{})
-			item2Data := make(map[string]interface{})
-			if err := json.Unmarshal([]byte(items[i]), &item1Data); err != nil {
-				logger.Errorf("Error unmarshaling item data: %v", err)
-				return false
-			}
-			if err := json.Unmarshal([]byte(items[j]), &item2Data); err != nil {
-				logger.Errorf("Error unmarshaling item data: %v", err)
-				return false
-			}
-			monitorTag1 := item1Data["monitor_tag"].(string)
-			monitorTag2 := item2Data["monitor_tag"].(string)
-
-			// Find the index of the tags in the sorted list
-			indexI := findIndex(fileConfig.MonitorTags, monitorTag1)
-			indexJ := findIndex(fileConfig.MonitorTags, monitorTag2)
-			return indexI < indexJ
+			// Order by the first monitor_tags entry each item matches
+			return fileConfig.tagIndex(items[i].MonitorTag) < fileConfig.tagIndex(items[j].MonitorTag)
 		})
 
-		// Write the Markdown content to the file
-		filePath := filepath.Join(dirPath, fmt.Sprintf("%s.md", fileName))
-		file, err := os.Create(filePath)
+		renderer, err := fileConfig.fileRenderer()
 		if err != nil {
-			return fmt.Errorf("error creating Markdown file %s: %v", filePath, err)
+			return nil, err
 		}
+		filePath := filepath.Join(dirPath, fileName+renderer.Extension())
 
-		// Check if there is meaningful content to include in the Markdown file
-		hasContent := false
+		// Only items with output make it into the file
+		withOutput := make([]Item, 0, len(items))
 		for _, item := range items {
-			var itemData map[string]interface{}
-			if err := json.Unmarshal([]byte(item), &itemData); err != nil {
-				logger.Errorf("Error unmarshaling item data: %v", err)
-				continue
-			}
-
-			description, _ := itemData["description"].(string)
-			output, _ := itemData["output"].(string)
-
-			// Skip writing to the Markdown file if the output is empty
-			if output != "" {
-				hasContent = true
-				decodedOutput, err := base64.StdEncoding.DecodeString(output)
-				if err != nil {
-					logger.Errorf("Error decoding output data: %v", err)
-					continue
-				}
-
-				_, err = fmt.Fprintf(file, "# %s\n```\n%s\n```\n", description, decodedOutput)
-				if err != nil {
-					logger.Errorf("Error writing to file %s: %v", filePath, err)
-				}
+			if item.Output != "" {
+				withOutput = append(withOutput, item)
 			}
 		}
+		hasContent := len(withOutput) > 0
 
-		// Close the file after writing all content
-		file.Close()
-
-		// Remove the file if it has no content
+		// Remove any previous file if there is no content this time
 		if !hasContent {
-			if err := os.Remove(filePath); err != nil {
-				logger.Errorf("Error removing empty Markdown file %s: %v", filePath, err)
-			} else {
-				logger.Debugf("Skipping empty Markdown file for %s (no content)", fileName)
+			removed, err := store.RemoveFile(filePath)
+			if err != nil {
+				logger.Errorf("Error removing empty file %s: %v", filePath, err)
+			} else if removed {
+				markPending(customer)
+				file := relativeFile(dataDir, filePath, true)
+				file.Removed = true
+				file.MonitorTags = itemTags(items)
+				files = append(files, file)
 			}
+			logger.Debugf("Skipping empty file for %s (no content)", fileName)
+			continue
 		}
-	}
 
-	return nil
-}
+		// Render the content in memory so the file is replaced in one step
+		var content bytes.Buffer
+		renderCtx := &RenderContext{
+			Customer: customer,
+			Instance: instance,
+			FileName: fileName,
+			PushTime: pushTime,
+			Items:    withOutput,
+		}
+		if err := renderer.Render(&content, renderCtx); err != nil {
+			return nil, fmt.Errorf("error rendering %s: %v", filePath, err)
+		}
 
-// findIndex finds the index of a string in a slice of strings.
-func findIndex(slice []string, str string) int {
-	for i, s := range slice {
-		if s == str {
-			return i
+		written, err := store.WriteFile(filePath, content.Bytes(), sortConfig.volatile)
+		if err != nil {
+			return nil, fmt.Errorf("error writing file %s: %v", filePath, err)
 		}
+		file := relativeFile(dataDir, filePath, written)
+		file.MonitorTags = itemTags(withOutput)
+		files = append(files, file)
+		if !written {
+			logger.Debugf("File %s is unchanged", filePath)
+			continue
+		}
+		markPending(customer)
+		markdownFilesWritten.WithLabelValues(customer).Inc()
 	}
-	return -1
+
+	return files, nil
 }
 
 // LoadSortConfig reads and parses the config.yaml file and returns the parsed data.
@@ -147,78 +164,133 @@ func LoadSortConfig(configFile string) (*SortConfig, error) {
 		return nil, fmt.Errorf("failed to parse config.yaml: %v", err)
 	}
 
-	return &config, nil
-}
+	for i := range config.FileConfigs {
+		if err := config.FileConfigs[i].prepare(filepath.Dir(configFile)); err != nil {
+			return nil, fmt.Errorf("file_config %s: %v", config.FileConfigs[i].FileName, err)
+		}
+	}
+	if config.Unmatched != nil {
+		config.Unmatched.MonitorTags = nil
+		if err := config.Unmatched.prepare(filepath.Dir(configFile)); err != nil {
+			return nil, fmt.Errorf("unmatched: %v", err)
+		}
+	}
 
-// ProcessDataMap is a function to process the JSON data map based on the config.yaml configuration.
-func ProcessDataMap(dataMap map[string]string, configFile, dataDir string, logger *logrus.Logger, customer string, instance string) {
-	sortConfig, err := LoadSortConfig(configFile)
-	if err != nil {
-		logger.Errorf("Error loading config.yaml: %v\n", err)
-		return
+	for _, pattern := range config.VolatileLines {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid volatile_lines pattern %q: %v", pattern, err)
+		}
+		config.volatile = append(config.volatile, re)
 	}
 
-	// Replace %INSTANCE% with the actual instance value in each file_name and directory
-	for i, fileConfig := range sortConfig.FileConfigs {
-		sortConfig.FileConfigs[i].FileName = strings.Replace(fileConfig.FileName, "%INSTANCE%", instance, -1)
-		sortConfig.FileConfigs[i].Directory = strings.Replace(fileConfig.Directory, "%INSTANCE%", instance, -1)
+	config.submitTemplate, err = parseSubmitDescription(config.SubmitDescription)
+	if err != nil {
+		return nil, fmt.Errorf("submit_description: %v", err)
 	}
 
-	// Create a map to group data by monitor tags specified in the config.yaml
-	groupedData := make(map[string][]string)
+	return &config, nil
+}
 
-	// Iterate over the FileConfigs and keep track of the tag order
-	tagOrder := make([]string, 0)
-	for _, fileConfig := range sortConfig.FileConfigs {
-		tagOrder = append(tagOrder, fileConfig.MonitorTags...)
+// prepare resolves the file config's renderer and template and compiles its monitor tags.
+// Template file paths are relative to configDir.
+func (fc *FileConfig) prepare(configDir string) error {
+	renderer, err := lookupRenderer(fc.Renderer)
+	if err != nil {
+		return err
 	}
-
-	// Group the data based on monitor tags and follow the tag order
-	for key, value := range dataMap {
-		// Parse the JSON data for each item
-		var itemData map[string]interface{}
-		err := json.Unmarshal([]byte(value), &itemData)
+	if fc.Template != "" {
+		tmpl, err := parseFileTemplate(fc.FileName, fc.Template, configDir)
 		if err != nil {
-			logger.Errorf("Error unmarshaling data for key %s: %v\n", key, err)
-			continue
+			return err
 		}
+		renderer = templateRenderer{extension: renderer.Extension(), tmpl: tmpl}
+	}
+	fc.renderer = renderer
+	return fc.compileMonitorTags()
+}
 
-		// Extract the monitor tag from the item data
-		monitorTag, tagExists := itemData["monitor_tag"].(string)
-		if !tagExists {
-			logger.Errorf("Missing monitor_tag in item %s\n", key)
-			continue
+// ProcessDataMap is a function to process the pushed items based on the config.yaml configuration.
+// user is the authenticated user who pushed the items. It returns the files rendered or removed.
+func ProcessDataMap(store VersionedStore, items []Item, dataDir string, logger *logrus.Logger, customer string, instance string, user string) ([]FileResult, error) {
+	configured := CurrentSortConfig()
+	values := newPathValues(customer, instance, user, time.Now())
+
+	// Group the data by file config: each item goes into every file with a monitor_tags entry
+	// matching its tag
+	matched := make([][]Item, len(configured.FileConfigs))
+	var unmatched []Item
+	for _, item := range items {
+		found := false
+		for index, fileConfig := range configured.FileConfigs {
+			if fileConfig.tagIndex(item.MonitorTag) >= 0 {
+				matched[index] = append(matched[index], item)
+				found = true
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, item)
 		}
+	}
 
-		// Check if the monitor tag is specified in the config.yaml
-		for _, tag := range tagOrder {
-			if strings.EqualFold(tag, monitorTag) {
-				for _, fileConfig := range sortConfig.FileConfigs {
-					if contains(fileConfig.MonitorTags, tag) {
-						groupedData[fileConfig.FileName] = append(groupedData[fileConfig.FileName], value)
-					}
-				}
-				break
+	if len(unmatched) > 0 {
+		var unknownTags []string
+		for _, item := range unmatched {
+			if !contains(unknownTags, item.MonitorTag) {
+				unknownTags = append(unknownTags, item.MonitorTag)
 			}
+			unmatchedItems.WithLabelValues(customer, item.MonitorTag).Inc()
+		}
+		logger.Warnf("Monitor tags matching no file config for customer: %s, instance: %s: %s", customer, instance, strings.Join(unknownTags, ", "))
+	}
+
+	// Substitute the placeholders in a copy of the configuration, so that the shared one is not
+	// touched. groupedData is keyed by the index of the file config so that entries sharing a
+	// file name do not mix their items; the catch-all file for unmatched items comes last.
+	sortConfig := *configured
+	sortConfig.FileConfigs = nil
+	groupedData := make(map[int][]Item)
+	addFiles := func(fileConfig FileConfig, items []Item) {
+		for _, group := range values.expand(fileConfig, items) {
+			groupedData[len(sortConfig.FileConfigs)] = group.items
+			sortConfig.FileConfigs = append(sortConfig.FileConfigs, group.fileConfig)
 		}
 	}
+	for index, fileConfig := range configured.FileConfigs {
+		addFiles(fileConfig, matched[index])
+	}
+	if configured.Unmatched != nil && len(unmatched) > 0 {
+		addFiles(*configured.Unmatched, unmatched)
+	}
 
 	// Now you can print the grouped data
 	logger.Debugf("Printing Grouped Data:")
-	for fileName, items := range groupedData {
-		logger.Debugf("File Name: %s\n", fileName)
+	for index, items := range groupedData {
+		logger.Debugf("File Name: %s\n", sortConfig.FileConfigs[index].FileName)
 		for _, item := range items {
-			logger.Debugf(item)
+			logger.Debugf("%s: %s", item.MonitorTag, item.Description)
 		}
 		logger.Debugf("----")
 	}
 
 	// Call the CreateMarkdownFiles function to generate Markdown files
-	err = CreateMarkdownFiles(dataDir, groupedData, sortConfig, logger, customer, instance)
+	files, err := CreateMarkdownFiles(store, dataDir, groupedData, &sortConfig, logger, customer, instance)
 	if err != nil {
 		logger.Errorf("Error creating Markdown files: %v\n", err)
+		return nil, err
 	}
+	return files, nil
+}
 
+// itemTags returns the distinct monitor tags of items, in order.
+func itemTags(items []Item) []string {
+	var tags []string
+	for _, item := range items {
+		if !contains(tags, item.MonitorTag) {
+			tags = append(tags, item.MonitorTag)
+		}
+	}
+	return tags
 }
 
 // contains checks if a string is present in a slice of strings.
@@ -231,63 +303,90 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
-func HandleJSONData(w http.ResponseWriter, req *http.Request, logger *logrus.Logger, configFile string, dataDir string, customer string, instance string) {
+// HandleJSONData renders a /json/ push into Markdown files, commits them to the store and
+// answers with a PushResponse. When queue is non-nil the commit is handed to it and the push is
+// acknowledged straight away.
+func HandleJSONData(w http.ResponseWriter, req *http.Request, logger *logrus.Logger, dataDir string, customer string, instance string, user string, store VersionedStore, queue *SubmitQueue) {
+	start := time.Now()
 	logger.Infof("Received JSON data for customer: %s, instance: %s", customer, instance)
 
-	// Process JSON data
-	var jsonData []map[string]interface{}
-	decoder := json.NewDecoder(req.Body)
-	if err := decoder.Decode(&jsonData); err != nil {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		logger.Errorf("Error reading body: %v", err)
+		http.Error(w, "Cannot read body", http.StatusBadRequest)
+		return
+	}
+
+	// Process JSON data, checking every item against the schema before anything is written
+	items, invalid, err := ValidateItems(body)
+	if err != nil {
+		jsonDecodeFailures.Inc()
 		http.Error(w, "Failed to decode JSON data", http.StatusBadRequest)
 		return
 	}
+	if len(invalid) > 0 {
+		jsonDecodeFailures.Inc()
+		logger.Warnf("Rejected JSON data for customer: %s, instance: %s with %d invalid items", customer, instance, len(invalid))
+		RespondInvalidItems(w, invalid)
+		return
+	}
+	RecordPush("json", customer, instance, len(body))
 
-	// Convert JSON data to a map[string]string for better understanding
-	dataMap := make(map[string]string)
-	for i, item := range jsonData {
-		itemStr, err := json.Marshal(item)
-		if err != nil {
-			http.Error(w, "Failed to convert JSON data to map", http.StatusInternalServerError)
-			return
-		}
-		dataMap[fmt.Sprintf("Item%d", i+1)] = string(itemStr)
+	// Log the JSON data for better understanding
+	logger.Debugf("JSON Data:")
+	for i, item := range items {
+		logger.Debugf("Item%d: %s: %s", i+1, item.MonitorTag, item.Description)
 	}
 
-	// Log the JSON data map for better understanding
-	logger.Debugf("JSON Data Map:")
-	for key, value := range dataMap {
-		logger.Debugf("%s: %s", key, value)
+	// Hold the customer lock while rendering, writing and submitting
+	resp := NewPushResponse(req, customer, instance, user, start)
+	unlock, ok := LockCustomer(customer)
+	if !ok {
+		logger.Warnf("Timed out waiting for lock on customer: %s", customer)
+		RespondBusy(w, customer)
+		return
 	}
+	defer unlock()
+	resp.Locked()
 
-	// Call the ProcessDataMap function to work with the data map
-	ProcessDataMap(dataMap, configFile, dataDir, logger, customer, instance)
+	// Compare with the previous push before its raw payload is superseded
+	resp.changedTags, resp.tagDigests = changedTags(dataDir, customer, instance, items)
 
-	// Run the P4 commands here
-	p4Command := "p4"
-	err := P4SyncIT(p4Command, dataDir, customer, instance, logger)
+	// Keep the payload so that the files can be rebuilt after config.yaml changes
+	raw, err := SaveRawPayload(store, dataDir, customer, instance, body)
 	if err != nil {
-		logger.Errorf("P4SyncIT error: %v", err)
+		logger.Errorf("Error saving raw payload: %v", err)
 	}
 
-	logger.Infof("P4 commands executed successfully")
+	// Call the ProcessDataMap function to work with the data map
+	files, err := ProcessDataMap(store, items, dataDir, logger, customer, instance, user)
+	if err != nil {
+		http.Error(w, "Failed to save data", http.StatusInternalServerError)
+		return
+	}
+	resp.Rendered(append(files, raw...))
+
+	FinishPush(w, store, queue, resp, logger)
 }
 
-func SaveData(dataDir, customer, instance, data string, logger *logrus.Logger) error {
+// SaveData writes the /data/ payload for instance and reports whether its content changed.
+func SaveData(store VersionedStore, dataDir, customer, instance, data string, logger *logrus.Logger) (FileResult, error) {
 	newpath := filepath.Join(dataDir, customer, "servers")
 	err := os.MkdirAll(newpath, os.ModePerm)
 	if err != nil {
-		return err
+		return FileResult{}, err
 	}
 	fname := filepath.Join(newpath, fmt.Sprintf("%s.md", instance))
-	f, err := os.Create(fname)
+	written, err := store.WriteFile(fname, []byte(data), CurrentSortConfig().volatile)
 	if err != nil {
-		logger.Errorf("Error opening %s: %v", fname, err)
-		return err
+		logger.Errorf("Error writing %s: %v", fname, err)
+		return FileResult{}, err
 	}
-	f.Write([]byte(data))
-	err = f.Close()
-	if err != nil {
-		logger.Errorf("Error closing file: %v", err)
+	if !written {
+		logger.Debugf("%s is unchanged", fname)
+	} else {
+		markPending(customer)
+		markdownFilesWritten.WithLabelValues(customer).Inc()
 	}
-	return nil
+	return relativeFile(dataDir, fname, written), nil
 }
@@ -0,0 +1,75 @@
+package functions
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// writeFileAtomic writes data to a temporary file in the target's directory, syncs it to disk
+// and renames it over path, so readers (including p4 reconcile) never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for %s: %v", path, err)
+	}
+	tmpName := tmp.Name()
+	// Clean up the temporary file on any failure below; after a successful rename this is a no-op
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %v", tmpName, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error syncing %s: %v", tmpName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing %s: %v", tmpName, err)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return fmt.Errorf("error setting permissions on %s: %v", tmpName, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %v", tmpName, path, err)
+	}
+	return nil
+}
+
+// writeFileIfChanged writes data to path unless the file already holds the same content,
+// ignoring lines matching any of the volatile patterns. It reports whether the file was written.
+func writeFileIfChanged(path string, data []byte, volatile []*regexp.Regexp) (bool, error) {
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(stripVolatileLines(existing, volatile), stripVolatileLines(data, volatile)) {
+		return false, nil
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// stripVolatileLines returns content without the lines matching any of the patterns.
+func stripVolatileLines(content []byte, volatile []*regexp.Regexp) []byte {
+	if len(volatile) == 0 {
+		return content
+	}
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		skip := false
+		for _, re := range volatile {
+			if re.Match(trimmed) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
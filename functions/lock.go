@@ -0,0 +1,62 @@
+package functions
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// customerLocks serializes rendering, writing and submitting for each customer so that two
+// pushes never work on the same customer directory at once.
+var customerLocks = struct {
+	mu    sync.Mutex
+	locks map[string]chan struct{}
+}{locks: make(map[string]chan struct{})}
+
+// lockTimeout is how long a push waits for its customer's lock before giving up.
+var lockTimeout = 30 * time.Second
+
+// SetLockTimeout sets how long a push waits for its customer's lock before giving up.
+func SetLockTimeout(timeout time.Duration) {
+	lockTimeout = timeout
+}
+
+func customerLock(customer string) chan struct{} {
+	customerLocks.mu.Lock()
+	defer customerLocks.mu.Unlock()
+	lock, ok := customerLocks.locks[customer]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		customerLocks.locks[customer] = lock
+	}
+	return lock
+}
+
+// LockCustomer acquires the customer's lock, waiting at most the configured lock timeout.
+// On success it returns a function that releases the lock.
+func LockCustomer(customer string) (func(), bool) {
+	lock := customerLock(customer)
+	timer := time.NewTimer(lockTimeout)
+	defer timer.Stop()
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// lockCustomerWait acquires the customer's lock, waiting as long as it takes.
+func lockCustomerWait(customer string) func() {
+	lock := customerLock(customer)
+	lock <- struct{}{}
+	return func() { <-lock }
+}
+
+// RespondBusy tells the client that the customer is locked by another push and when to retry.
+func RespondBusy(w http.ResponseWriter, customer string) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Max(1, math.Ceil(lockTimeout.Seconds())))))
+	http.Error(w, fmt.Sprintf("Customer %s is busy with another push, retry later", customer), http.StatusServiceUnavailable)
+}
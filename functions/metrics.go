@@ -0,0 +1,99 @@
+package functions
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "datapushgateway"
+
+var (
+	pushesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pushes_received_total",
+		Help:      "Number of accepted pushes by customer, instance and endpoint.",
+	}, []string{"customer", "instance", "endpoint"})
+
+	bytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "received_bytes_total",
+		Help:      "Bytes of request body received by customer, instance and endpoint.",
+	}, []string{"customer", "instance", "endpoint"})
+
+	lastPushTimestamp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_push_timestamp_seconds",
+		Help:      "Unix time of the last accepted push by customer and instance.",
+	}, []string{"customer", "instance"})
+
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of requests rejected for failed authentication or authorization by endpoint.",
+	}, []string{"endpoint"})
+
+	jsonDecodeFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "json_decode_failures_total",
+		Help:      "Number of /json/ pushes whose body could not be decoded.",
+	})
+
+	markdownFilesWritten = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "markdown_files_written_total",
+		Help:      "Number of report files written by customer, whatever their renderer.",
+	}, []string{"customer"})
+
+	unmatchedItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unmatched_items_total",
+		Help:      "Number of /json/ items whose monitor tag matches no file config, by customer and tag.",
+	}, []string{"customer", "monitor_tag"})
+
+	p4LoggedIn = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "p4_logged_in",
+		Help:      "Whether the gateway holds a valid Perforce ticket (1) or not (0).",
+	})
+
+	p4TicketExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "p4_ticket_expiry_timestamp_seconds",
+		Help:      "Unix time at which the gateway's Perforce ticket expires.",
+	})
+
+	p4CommandDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "p4_command_duration_seconds",
+		Help:      "Duration of p4 commands by subcommand.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"command"})
+
+	p4CommandFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "p4_command_failures_total",
+		Help:      "Number of failed p4 commands by subcommand.",
+	}, []string{"command"})
+)
+
+// RecordPush records an accepted push of size bytes for customer and instance.
+func RecordPush(endpoint, customer, instance string, size int) {
+	pushesReceived.WithLabelValues(customer, instance, endpoint).Inc()
+	bytesReceived.WithLabelValues(customer, instance, endpoint).Add(float64(size))
+	lastPushTimestamp.WithLabelValues(customer, instance).SetToCurrentTime()
+}
+
+// RecordAuthFailure records a request rejected by authentication or authorization.
+func RecordAuthFailure(endpoint string) {
+	authFailures.WithLabelValues(endpoint).Inc()
+}
+
+// observeP4Command records the duration and outcome of a p4 subcommand.
+func observeP4Command(command string, start time.Time, err error) {
+	p4CommandDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	if err != nil {
+		p4CommandFailures.WithLabelValues(command).Inc()
+	}
+}
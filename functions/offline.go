@@ -0,0 +1,93 @@
+package functions
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// localStore writes files without recording revisions, for rendering outside the gateway.
+type localStore struct {
+	workingTree
+}
+
+func (localStore) Commit(customer, message string) (*Revision, error) {
+	return nil, nil
+}
+
+func (localStore) History(customer string, max int) ([]Revision, error) {
+	return []Revision{}, nil
+}
+
+// RenderPayloadFile renders a saved /json/ payload, which may be gzip compressed, into outDir
+// with the current configuration, as the gateway would for a push by user from customer and
+// instance, but without recording anything. It returns the files written or removed.
+func RenderPayloadFile(payloadFile, outDir, customer, instance, user string, logger *logrus.Logger) ([]string, error) {
+	if !validName.MatchString(customer) || !validName.MatchString(instance) {
+		return nil, fmt.Errorf("invalid customer or instance name")
+	}
+	body, err := readPayloadFile(payloadFile)
+	if err != nil {
+		return nil, err
+	}
+	items, invalid, err := ValidateItems(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JSON data: %v", err)
+	}
+	if len(invalid) > 0 {
+		var problems []string
+		for _, item := range invalid {
+			problems = append(problems, fmt.Sprintf("item %d: %s", item.Index, strings.Join(item.Errors, ", ")))
+		}
+		return nil, fmt.Errorf("JSON data does not match the item schema: %s", strings.Join(problems, "; "))
+	}
+	files, err := ProcessDataMap(localStore{}, items, outDir, logger, customer, instance, user)
+	if err != nil {
+		return nil, err
+	}
+	return joinPaths(outDir, ChangedPaths(files)), nil
+}
+
+// DiffOutput writes a unified diff against compareDir of every file rendered for the customer
+// under outDir, using diff(1). It reports whether any file differs.
+func DiffOutput(w io.Writer, outDir, compareDir, customer string) (bool, error) {
+	renderedDir := filepath.Join(outDir, customer)
+	differs := false
+	err := filepath.WalkDir(renderedDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip snapshots, temporary files and anything else hidden
+		if path != renderedDir && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(outDir, path)
+		if err != nil {
+			return err
+		}
+		existing := filepath.Join(compareDir, rel)
+		output, err := exec.Command("diff", "-u", "-N", "--label", filepath.ToSlash(existing), "--label", filepath.ToSlash(path), existing, path).Output()
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			// Exit status 1 means the files differ
+			differs = true
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("error comparing %s: %v", rel, err)
+		}
+		_, err = w.Write(output)
+		return err
+	})
+	return differs, err
+}
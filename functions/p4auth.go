@@ -0,0 +1,203 @@
+package functions
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// P4PasswordEnv is the environment variable the Perforce password can be passed in, as an
+// alternative to p4passwordfile.
+const P4PasswordEnv = "DATAPUSHGATEWAY_P4PASSWD"
+
+// P4Auth keeps the gateway logged in to Perforce without a terminal. It logs in with the
+// password from p4passwordfile or DATAPUSHGATEWAY_P4PASSWD, or relies on a ticket provisioned
+// beforehand, and refreshes the ticket before it expires. The client and password file are
+// taken from the configuration in effect at each check, so a reload applies to the next one.
+type P4Auth struct {
+	refreshBefore time.Duration
+	logger        *logrus.Logger
+
+	mu      sync.Mutex
+	expires time.Time // zero if the ticket does not expire
+	err     error     // why the gateway is not logged in, nil if it is
+}
+
+// NewP4Auth creates the login manager. Tickets expiring within refreshBefore are refreshed.
+func NewP4Auth(refreshBefore time.Duration, logger *logrus.Logger) *P4Auth {
+	return &P4Auth{
+		refreshBefore: refreshBefore,
+		logger:        logger,
+		err:           fmt.Errorf("login not checked yet"),
+	}
+}
+
+// password returns the configured password, or "" if there is none.
+func (a *P4Auth) password() (string, error) {
+	passwordFile := CurrentConfig().ApplicationConfig.P4PasswordFile
+	if passwordFile != "" {
+		info, err := os.Stat(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading p4passwordfile: %v", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			a.logger.Warnf("p4passwordfile %s is readable by other users", passwordFile)
+		}
+		content, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading p4passwordfile: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return os.Getenv(P4PasswordEnv), nil
+}
+
+// loginStatus runs 'p4 login -s' and returns when the ticket expires, zero if it does not.
+func (a *P4Auth) loginStatus() (time.Time, error) {
+	result, err := CurrentP4Client().RunTagged("", "login", "-s")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("not logged in: %v", err)
+	}
+	for _, record := range result.Records {
+		if expiration, ok := record["TicketExpiration"]; ok {
+			seconds, _ := strconv.Atoi(expiration)
+			return time.Now().Add(time.Duration(seconds) * time.Second), nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// Check makes sure the gateway holds a valid ticket, logging in again with the configured
+// password if the ticket is missing or expires within the refresh window. It never prompts.
+func (a *P4Auth) Check() error {
+	expires, statusErr := a.loginStatus()
+	if statusErr == nil && (expires.IsZero() || time.Until(expires) > a.refreshBefore) {
+		return a.record(expires, nil)
+	}
+
+	password, err := a.password()
+	if err != nil {
+		return a.record(time.Time{}, err)
+	}
+	if password == "" {
+		if statusErr == nil {
+			// Still valid, but nothing to refresh it with
+			a.logger.Warnf("Perforce ticket expires at %s and no password is configured to refresh it", expires.Format(time.RFC3339))
+			return a.record(expires, nil)
+		}
+		return a.record(time.Time{}, fmt.Errorf("%v, and no password is configured (set p4passwordfile or %s)", statusErr, P4PasswordEnv))
+	}
+
+	if err := a.login(password); err != nil {
+		if statusErr == nil {
+			a.logger.Errorf("Failed to refresh Perforce ticket expiring at %s: %v", expires.Format(time.RFC3339), err)
+			return a.record(expires, nil)
+		}
+		return a.record(time.Time{}, err)
+	}
+	expires, err = a.loginStatus()
+	return a.record(expires, err)
+}
+
+// Prompt logs in with a password read from the terminal. It fails if stdin is not a terminal,
+// as under systemd.
+func (a *P4Auth) Prompt() error {
+	if !term.IsTerminal(int(syscall.Stdin)) {
+		return fmt.Errorf("cannot prompt for the Perforce password: stdin is not a terminal")
+	}
+
+	// Prompt for password and login
+	fmt.Print("Enter Perforce password: ")
+
+	// Disable echoing of input characters
+	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println() // Print a newline to move to the next line
+	if err != nil {
+		return fmt.Errorf("failed to read password: %v", err)
+	}
+
+	if err := a.login(string(bytePassword)); err != nil {
+		return a.record(time.Time{}, err)
+	}
+	expires, err := a.loginStatus()
+	return a.record(expires, err)
+}
+
+func (a *P4Auth) login(password string) error {
+	// Handle trust if needed
+	p4 := CurrentP4Client()
+	if err := handleP4Trust(p4, a.logger); err != nil {
+		return err
+	}
+	if err := runP4Login(p4, password, a.logger); err != nil {
+		return fmt.Errorf("p4 login failed: %v", err)
+	}
+	return nil
+}
+
+func (a *P4Auth) record(expires time.Time, err error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.expires = expires
+	a.err = err
+	if err == nil {
+		p4LoggedIn.Set(1)
+	} else {
+		p4LoggedIn.Set(0)
+	}
+	if !expires.IsZero() {
+		p4TicketExpiry.Set(float64(expires.Unix()))
+	}
+	return err
+}
+
+// Healthy returns why the gateway is not logged in to Perforce, or nil if it is.
+func (a *P4Auth) Healthy() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	if !a.expires.IsZero() && time.Now().After(a.expires) {
+		return fmt.Errorf("Perforce ticket expired at %s", a.expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Watch runs Check every interval, refreshing the ticket before it expires, until stop is
+// closed. A nil stop channel keeps checking for the lifetime of the process. interval must be
+// positive.
+func (a *P4Auth) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := a.Check(); err != nil {
+				a.logger.Errorf("Perforce login check failed: %v", err)
+			}
+		}
+	}
+}
+
+// HandleHealth serves /-/healthy, failing with 503 while the gateway cannot submit to
+// Perforce. auth is nil for storage backends that need no login.
+func HandleHealth(w http.ResponseWriter, req *http.Request, auth *P4Auth) {
+	if auth != nil {
+		if err := auth.Healthy(); err != nil {
+			http.Error(w, fmt.Sprintf("Perforce login: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.Write([]byte("OK\n"))
+}
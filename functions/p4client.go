@@ -0,0 +1,147 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/perforce/p4prometheus/version"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultP4Prog identifies the gateway's commands in the Perforce server log (p4 -zprog).
+const defaultP4Prog = "datapushgateway"
+
+// defaultP4Timeout bounds every p4 command unless p4timeout is set in config.yaml.
+const defaultP4Timeout = 5 * time.Minute
+
+// P4Client runs p4 commands with the binary, environment, timeout and global flags from
+// config.yaml, so that every command the gateway runs is consistent and identifiable.
+type P4Client struct {
+	// Bin is the p4 executable.
+	Bin string
+	// Env is added to the gateway's environment, including P4CONFIG.
+	Env []string
+	// Timeout is how long a command may run before it is killed. Zero means no limit.
+	Timeout time.Duration
+	// GlobalFlags go before the command, starting with -zprog and -zversion.
+	GlobalFlags []string
+
+	logger *logrus.Logger
+}
+
+// currentP4 is the client built from the application config currently in effect. It is
+// replaced when a reload changes applicationConfig.
+var currentP4 atomic.Pointer[P4Client]
+
+// SetP4Client makes c the client used for all p4 commands.
+func SetP4Client(c *P4Client) {
+	currentP4.Store(c)
+}
+
+// CurrentP4Client returns the client used for p4 commands, nil before SetP4Client is called.
+func CurrentP4Client() *P4Client {
+	return currentP4.Load()
+}
+
+// NewP4Client creates a client for the application config.
+func NewP4Client(config ApplicationConfig, logger *logrus.Logger) *P4Client {
+	env := []string{"P4CONFIG=" + config.P4Config}
+	names := make([]string, 0, len(config.P4Env))
+	for name := range config.P4Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, name+"="+config.P4Env[name])
+	}
+
+	prog := config.P4Prog
+	if prog == "" {
+		prog = defaultP4Prog
+	}
+	globalFlags := []string{"-zprog=" + prog}
+	if version.Version != "" {
+		globalFlags = append(globalFlags, "-zversion="+version.Version)
+	}
+	globalFlags = append(globalFlags, config.P4Flags...)
+
+	timeout := defaultP4Timeout
+	if config.P4Timeout != nil {
+		timeout = *config.P4Timeout
+	}
+	return &P4Client{
+		Bin:         config.P4Bin,
+		Env:         env,
+		Timeout:     timeout,
+		GlobalFlags: globalFlags,
+		logger:      logger,
+	}
+}
+
+// Run runs a p4 command and returns its combined output. If dir is set it is passed with -d,
+// so that the workspace is found from that directory.
+func (c *P4Client) Run(dir string, args ...string) ([]byte, error) {
+	return c.run(dir, nil, args...)
+}
+
+// RunWithInput runs a p4 command with input on its standard input.
+func (c *P4Client) RunWithInput(input string, args ...string) ([]byte, error) {
+	return c.run("", strings.NewReader(input), args...)
+}
+
+func (c *P4Client) run(dir string, stdin *strings.Reader, args ...string) ([]byte, error) {
+	cmdArgs := append([]string(nil), c.GlobalFlags...)
+	if dir != "" {
+		cmdArgs = append(cmdArgs, "-d", dir)
+	}
+	cmdArgs = append(cmdArgs, args...)
+
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	// Log the full command for debugging
+	c.logger.Debugf("Executing P4 command: %s %v", c.Bin, cmdArgs)
+
+	cmd := exec.CommandContext(ctx, c.Bin, cmdArgs...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	start := time.Now()
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", c.Timeout)
+	}
+	observeP4Command(p4Subcommand(args), start, err)
+	if err != nil {
+		c.logger.Debugf("Command output: %s", output.String())
+		return output.Bytes(), fmt.Errorf("'%s %s' failed: %v", c.Bin, strings.Join(cmdArgs, " "), err)
+	}
+	c.logger.Debugf("Command output: %s", output.String())
+	return output.Bytes(), nil
+}
+
+// p4Subcommand returns the command name in args, skipping any global flags such as -ztag.
+func p4Subcommand(args []string) string {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return arg
+		}
+	}
+	return ""
+}
@@ -1,112 +1,130 @@
 package functions
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
-	"syscall"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
-	"golang.org/x/term"
 	"gopkg.in/yaml.v2"
 )
 
 type ApplicationConfig struct {
 	P4Config string `yaml:"P4CONFIG"`
 	P4Bin    string `yaml:"p4bin"`
+	// P4Timeout limits how long each p4 command may run, 5m by default and 0 for no limit.
+	P4Timeout *time.Duration `yaml:"p4timeout"`
+	// P4Prog is passed as -zprog so that the gateway's commands show in the server log.
+	P4Prog string `yaml:"p4prog"`
+	// P4Env holds additional environment variables for p4, such as P4CHARSET.
+	P4Env map[string]string `yaml:"p4env"`
+	// P4Flags are additional global flags placed before every p4 command.
+	P4Flags []string `yaml:"p4flags"`
+	// P4PasswordFile holds the password used to log in, and to refresh the ticket before it
+	// expires, without a terminal.
+	P4PasswordFile string `yaml:"p4passwordfile"`
 }
 
 type Config struct {
 	ApplicationConfig ApplicationConfig `yaml:"applicationConfig"`
+	Storage           StorageConfig     `yaml:"storage"`
 }
 
-var p4ConfigPath string
-var p4Bin string
+// configState is the configuration currently in effect. It is replaced as a whole on reload.
+type configState struct {
+	config     *Config
+	sortConfig *SortConfig
+}
+
+var currentConfig atomic.Pointer[configState]
 
+func init() {
+	currentConfig.Store(&configState{config: &Config{}, sortConfig: &SortConfig{}})
+}
+
+// CurrentConfig returns the application configuration currently in effect.
+func CurrentConfig() *Config {
+	return currentConfig.Load().config
+}
+
+// CurrentSortConfig returns the file sorting configuration currently in effect.
+func CurrentSortConfig() *SortConfig {
+	return currentConfig.Load().sortConfig
+}
+
+// LoadConfig parses and validates the config file and makes it the active configuration.
 func LoadConfig(configFile string) (*Config, error) {
-	configData, err := os.ReadFile(configFile)
+	state, err := parseConfig(configFile)
 	if err != nil {
 		return nil, err
 	}
+	currentConfig.Store(state)
 
-	var config Config
-	err = yaml.Unmarshal(configData, &config)
+	// Add a debug log statement to show the loaded .p4config path
+	logger.Debugf("Loaded .p4config file: %s", state.config.ApplicationConfig.P4Config)
+	return state.config, nil
+}
+
+func parseConfig(configFile string) (*configState, error) {
+	config, err := decodeConfig(configFile)
 	if err != nil {
 		return nil, err
 	}
-
-	p4ConfigPath = config.ApplicationConfig.P4Config
-	if p4ConfigPath == "" {
-		return &config, fmt.Errorf("P4CONFIG not found or is empty in config.yaml")
-	}
-
-	p4Bin = config.ApplicationConfig.P4Bin
-	if p4Bin == "" {
-		p4Bin = "p4" // Assume in path
+	sortConfig, err := LoadSortConfig(configFile)
+	if err != nil {
+		return nil, err
 	}
-
-	// Add a debug log statement to show the loaded .p4config path
-	logger.Debugf("Loaded .p4config file: %s", p4ConfigPath)
-	return &config, nil
+	return &configState{config: config, sortConfig: sortConfig}, nil
 }
 
-func P4Login(logger *logrus.Logger) error {
-	os.Setenv("P4CONFIG", p4ConfigPath)
-
-	// Check if already logged in using 'p4 login -s'
-	logger.Debugf("Executing p4 login -s")
-	loginStatusCmd := exec.Command(p4Bin, "login", "-s")
-	if err := loginStatusCmd.Run(); err == nil {
-		logger.Info("Already logged in to Perforce.")
-		return nil // Already logged in
-	}
-
-	// Handle trust if needed
-	if err := handleP4Trust(logger); err != nil {
-		return err
+// decodeConfig reads the application and storage settings from the config file.
+func decodeConfig(configFile string) (*Config, error) {
+	configData, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, err
 	}
 
-	// Prompt for password and login
-	fmt.Print("Enter Perforce password: ")
-
-	// Disable echoing of input characters
-	bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+	var config Config
+	err = yaml.Unmarshal(configData, &config)
 	if err != nil {
-		return fmt.Errorf("failed to read password: %v", err)
+		return nil, err
 	}
 
-	password := string(bytePassword)
-	fmt.Println() // Print a newline to move to the next line
-
-	return runP4Login(password, logger)
-}
-
-func HasValidTicket(logger *logrus.Logger) bool {
-	os.Setenv("P4CONFIG", p4ConfigPath)
-	cmd := exec.Command(p4Bin, "tickets")
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Debugf("Error checking tickets: %s", output)
-		return false
+	if storageOverride != "" {
+		config.Storage.Type = storageOverride
+	}
+	if config.Storage.Type == "" {
+		config.Storage.Type = StorageP4
+	}
+	switch config.Storage.Type {
+	case StorageP4:
+		if config.ApplicationConfig.P4Config == "" {
+			return nil, fmt.Errorf("P4CONFIG not found or is empty in config.yaml")
+		}
+	case StorageGit, StorageFilesystem:
+	default:
+		return nil, fmt.Errorf("unknown storage type %q in config.yaml", config.Storage.Type)
 	}
-	return strings.Contains(string(output), "ticket expires in")
+	if config.ApplicationConfig.P4Bin == "" {
+		config.ApplicationConfig.P4Bin = "p4" // Assume in path
+	}
+	return &config, nil
 }
 
-func handleP4Trust(logger *logrus.Logger) error {
+func handleP4Trust(p4 *P4Client, logger *logrus.Logger) error {
 	// Check if trust is already established
-	checkTrustCmd := exec.Command(p4Bin, "trust", "-l")
-	checkOutput, checkErr := checkTrustCmd.CombinedOutput()
+	checkOutput, checkErr := p4.Run("", "trust", "-l")
 	if checkErr == nil && strings.Contains(string(checkOutput), "Trust already established") {
 		logger.Info("Perforce trust already established.")
 		return nil // Trust is already established, no need to proceed further
 	}
 
 	// Establish trust
-	cmd := exec.Command(p4Bin, "trust", "-y")
-	output, err := cmd.CombinedOutput()
+	output, err := p4.Run("", "trust", "-y")
 	if err != nil {
 		logger.Errorf("Error running 'p4 trust': %v", err)
 		logger.Errorf("Output: %s", output)
@@ -116,107 +134,64 @@ func handleP4Trust(logger *logrus.Logger) error {
 	return nil
 }
 
-func runP4Login(password string, logger *logrus.Logger) error {
-	cmd := exec.Command(p4Bin, "login", "-a")
-	var stdin bytes.Buffer
-	stdin.Write([]byte(password + "\n"))
-	cmd.Stdin = &stdin
-
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
+func runP4Login(p4 *P4Client, password string, logger *logrus.Logger) error {
+	output, err := p4.RunWithInput(password+"\n", "login", "-a")
 	if err != nil {
 		logger.Errorf("Error running 'p4 login': %v", err)
-		logger.Errorf("Stderr: %s", stderr.String())
+		logger.Errorf("Output: %s", output)
 		return err
 	}
 
-	logger.Infof("Stdout: %s", stdout.String())
+	logger.Infof("Stdout: %s", output)
 	return nil
 }
 
-func RunP4CommandWithEnvAndDir(command string, args []string, includeDataDir bool, dataDir string, customer string, logger *logrus.Logger) error {
-	os.Setenv("P4CONFIG", p4ConfigPath)
-	cmdArgs := make([]string, 0)
-	if includeDataDir {
-		dataFlag := filepath.Join(dataDir, customer)
-		cmdArgs = append(cmdArgs, "-d", dataFlag)
-	}
-	cmdArgs = append(cmdArgs, args...)
-
-	// Log the full command for debugging
-	logger.Debugf("Executing P4 command: %s %v", command, cmdArgs)
-
-	cmd := exec.Command(command, cmdArgs...)
-	output, err := cmd.CombinedOutput()
+// P4SyncIT reconciles the customer's directory with Perforce and submits any changes with the
+// given description. It returns the submitted changelist number, or 0 if there was nothing
+// to submit.
+func P4SyncIT(p4 *P4Client, dataDir, customer, description string, logger *logrus.Logger) (int, error) {
+	// p4 resolves file arguments against -d, so a relative data directory would be applied twice
+	customerDir, err := filepath.Abs(filepath.Join(dataDir, customer))
 	if err != nil {
-		logger.Errorf("Error executing command '%s %v': %v", command, cmdArgs, err)
-		logger.Debugf("Command output: %s", string(output))
-		return err
+		return 0, fmt.Errorf("error resolving customer directory: %v", err)
 	}
+	customerDirPath := filepath.Join(customerDir, "...")
 
-	// Log command output
-	logger.Debugf("Command output: %s", string(output))
-	return nil
-}
-
-func P4SyncIT(p4Command, dataDir, customer, instance string, logger *logrus.Logger) error {
-	recArgs := []string{"rec"}
-	syncArgs := []string{"sync"}
-	resolveArgs := []string{"resolve", "-ay"}
-	customerDirPath := filepath.Join(dataDir, customer, "/...")
-
-	// Run 'p4 rec'
-	logger.Infof("Running P4 command: %s %s", p4Command, strings.Join(recArgs, " "))
-	if err := RunP4CommandWithEnvAndDir(p4Command, recArgs, true, dataDir, customer, logger); err != nil {
-		logger.Errorf("Error running 'p4 rec': %v", err)
-		return err
+	// Keep every command to the customer's files; other customers share the workspace
+	for _, args := range [][]string{{"rec", customerDirPath}, {"sync", customerDirPath}, {"resolve", "-ay", customerDirPath}} {
+		logger.Infof("Running P4 command: %s %s", p4.Bin, strings.Join(args, " "))
+		result, err := p4.RunTagged(customerDir, args...)
+		if err != nil {
+			logger.Errorf("Error running 'p4 %s': %v", strings.Join(args, " "), err)
+			return 0, err
+		}
+		for _, message := range result.Messages {
+			logger.Debugf("p4 %s: %s", args[0], strings.TrimSpace(message.Data))
+		}
 	}
 
-	// Run 'p4 sync'
-	logger.Infof("Running P4 command: %s %s", p4Command, strings.Join(syncArgs, " "))
-	if err := RunP4CommandWithEnvAndDir(p4Command, syncArgs, true, dataDir, customer, logger); err != nil {
-		logger.Errorf("Error running 'p4 sync': %v", err)
-		return err
+	// Check for changes to submit
+	opened, err := p4.Opened(customerDirPath)
+	if err != nil {
+		logger.Errorf("Error running 'p4 opened': %v", err)
+		return 0, err
 	}
-
-	// Run 'p4 resolve -ay'
-	logger.Infof("Running P4 command: %s %s", p4Command, strings.Join(resolveArgs, " "))
-	if err := RunP4CommandWithEnvAndDir(p4Command, resolveArgs, true, dataDir, customer, logger); err != nil {
-		logger.Errorf("Error running 'p4 resolve -ay': %v", err)
-		return err
+	if len(opened) == 0 {
+		logger.Info("No changes to submit.")
+		return 0, nil
 	}
 
-	// Check for changes to submit
-	if hasChangesToSubmit(p4Command, customerDirPath, logger) {
-		// Construct and execute the 'p4 submit' command
-		submitCmdArgs := []string{
-			"submit",
-			"-d", fmt.Sprintf("Customer: %s, Instance: %s, monitoring submit", customer, instance),
-			customerDirPath,
-		}
-		logger.Infof("Running P4 command: %s submit %s", p4Command, strings.Join(submitCmdArgs, " "))
-		if err := RunP4CommandWithEnvAndDir(p4Command, submitCmdArgs, false, "", customer, logger); err != nil {
-			logger.Errorf("Error running 'p4 submit': %v", err)
-			return err
-		}
-	} else {
+	logger.Infof("Running P4 command: %s submit -d %q %s (%d files)", p4.Bin, description, customerDirPath, len(opened))
+	change, err := p4.Submit(description, customerDirPath)
+	if errors.Is(err, ErrNothingToSubmit) {
 		logger.Info("No changes to submit.")
+		return 0, nil
 	}
-
-	logger.Infof("P4 commands executed successfully")
-	return nil
-}
-
-func hasChangesToSubmit(p4Command, customerDirPath string, logger *logrus.Logger) bool {
-	cmdArgs := []string{"opened", customerDirPath}
-	cmd := exec.Command(p4Command, cmdArgs...)
-	output, err := cmd.CombinedOutput()
 	if err != nil {
-		logger.Debugf("Error checking for changes: %v", err)
-		return false
+		logger.Errorf("Error running 'p4 submit': %v", err)
+		return 0, err
 	}
-	return strings.Contains(string(output), "//")
+
+	logger.Infof("Submitted change %d", change)
+	return change, nil
 }
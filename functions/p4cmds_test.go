@@ -0,0 +1,155 @@
+package functions
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Output as printed by p4 -ztag -Mj for each case.
+const (
+	p4OpenedOutput = `{"depotFile":"//monitoring/acme/servers/i1/p4.md","clientFile":"//gw/acme/servers/i1/p4.md","rev":"3","haveRev":"3","action":"edit","change":"default","type":"text","user":"gw","client":"gw"}
+{"depotFile":"//monitoring/acme/servers/i1/new.md","clientFile":"//gw/acme/servers/i1/new.md","rev":"none","haveRev":"none","action":"add","change":"default","type":"text","user":"gw","client":"gw"}
+`
+	p4NotOpenedOutput = `{"data":"//gw/acme/... - file(s) not opened on this client.\n","severity":2,"generic":17}
+`
+	p4SubmitOutput = `{"change":"1041","openFiles":"1"}
+{"depotFile":"//monitoring/acme/servers/i1/p4.md","rev":"4","action":"edit"}
+{"submittedChange":"1042"}
+`
+	p4NoFilesOutput = `{"data":"No files to submit from the default changelist.\n","severity":3,"generic":17}
+`
+	p4LockedOutput = `{"data":"Change 1041 created with 1 open file(s).\n","severity":1,"generic":0}
+{"data":"//monitoring/acme/servers/i1/p4.md - file(s) locked by another user.\n","severity":3,"generic":35}
+`
+	p4ConnectOutput = `Perforce client error:
+	Connect to server failed; check $P4PORT.
+	TCP connect to perforce:1666 failed.
+`
+)
+
+// fakeP4 returns a client whose p4 prints output and exits with code.
+func fakeP4(t *testing.T, output string, code int) *P4Client {
+	t.Helper()
+	dir := t.TempDir()
+	outputFile := filepath.Join(dir, "output")
+	if err := os.WriteFile(outputFile, []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "p4")
+	script := "#!/bin/sh\ncat \"$FAKE_P4_OUTPUT\"\nexit " + strconv.Itoa(code) + "\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &P4Client{Bin: bin, Env: []string{"FAKE_P4_OUTPUT=" + outputFile}, logger: logger}
+}
+
+func TestRunTagged(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		code     int
+		records  int
+		messages int
+		errors   int
+		wantErr  bool
+	}{
+		{"records", p4OpenedOutput, 0, 2, 0, 0, false},
+		{"warning", p4NotOpenedOutput, 0, 0, 1, 0, false},
+		{"empty", "", 0, 0, 0, 0, false},
+		{"error", p4NoFilesOutput, 1, 0, 0, 1, true},
+		{"error with zero exit", p4NoFilesOutput, 0, 0, 0, 1, true},
+		{"info and error", p4LockedOutput, 1, 0, 1, 1, true},
+		{"not JSON", "p4 client output\n", 0, 0, 1, 0, false},
+		{"not JSON on failure", p4ConnectOutput, 1, 0, 0, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := fakeP4(t, test.output, test.code).RunTagged("", "opened")
+			if len(result.Records) != test.records {
+				t.Errorf("got %d records, want %d", len(result.Records), test.records)
+			}
+			if len(result.Messages) != test.messages {
+				t.Errorf("got %d messages, want %d", len(result.Messages), test.messages)
+			}
+			if !test.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var p4Err *P4Error
+			if !errors.As(err, &p4Err) {
+				t.Fatalf("got error %v, want a *P4Error", err)
+			}
+			if p4Err.Command != "opened" {
+				t.Errorf("got command %q, want opened", p4Err.Command)
+			}
+			if len(p4Err.Messages) != test.errors {
+				t.Errorf("got %d error messages, want %d", len(p4Err.Messages), test.errors)
+			}
+		})
+	}
+}
+
+func TestOpened(t *testing.T) {
+	files, err := fakeP4(t, p4OpenedOutput, 0).Opened("//gw/acme/...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []P4OpenedFile{
+		{DepotFile: "//monitoring/acme/servers/i1/p4.md", ClientFile: "//gw/acme/servers/i1/p4.md", Action: "edit", Change: "default", Type: "text", Rev: 3},
+		{DepotFile: "//monitoring/acme/servers/i1/new.md", ClientFile: "//gw/acme/servers/i1/new.md", Action: "add", Change: "default", Type: "text"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(files), len(want))
+	}
+	for i := range want {
+		if files[i] != want[i] {
+			t.Errorf("file %d = %+v, want %+v", i, files[i], want[i])
+		}
+	}
+
+	files, err = fakeP4(t, p4NotOpenedOutput, 0).Opened("//gw/acme/...")
+	if err != nil || len(files) != 0 {
+		t.Errorf("Opened with nothing opened = %v, %v, want no files", files, err)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		code    int
+		change  int
+		nothing bool
+		wantErr bool
+	}{
+		{"submitted", p4SubmitOutput, 0, 1042, false, false},
+		{"no files", p4NoFilesOutput, 1, 0, true, true},
+		{"locked", p4LockedOutput, 1, 0, false, true},
+		{"connect failure", p4ConnectOutput, 1, 0, false, true},
+		{"no change number", `{"change":"1041","openFiles":"1"}` + "\n", 0, 0, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			change, err := fakeP4(t, test.output, test.code).Submit("test", "//gw/acme/...")
+			if change != test.change {
+				t.Errorf("got change %d, want %d", change, test.change)
+			}
+			if got := errors.Is(err, ErrNothingToSubmit); got != test.nothing {
+				t.Errorf("errors.Is(%v, ErrNothingToSubmit) = %v, want %v", err, got, test.nothing)
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
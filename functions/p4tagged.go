@@ -0,0 +1,181 @@
+package functions
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Severities of messages from the Perforce server. Messages below P4SeverityFailed (warnings
+// are 2) are informational; P4SeverityFailed and above (fatal is 4) are errors.
+const (
+	P4SeverityInfo   = 1
+	P4SeverityFailed = 3
+)
+
+// p4GenericEmpty is the generic code of messages such as "No files to submit".
+const p4GenericEmpty = 17
+
+// ErrNothingToSubmit is returned by Submit when there are no opened files to submit.
+var ErrNothingToSubmit = errors.New("nothing to submit")
+
+// P4Message is an informational, warning or error message from a tagged p4 command.
+type P4Message struct {
+	Data     string `json:"data"`
+	Severity int    `json:"severity"`
+	Generic  int    `json:"generic"`
+}
+
+// P4Record is one tagged output record, such as one opened file.
+type P4Record map[string]string
+
+// P4Result is the parsed output of a tagged p4 command.
+type P4Result struct {
+	Records []P4Record
+	// Messages holds the informational messages and warnings; errors are returned as *P4Error.
+	Messages []P4Message
+}
+
+// P4Error is a p4 command that failed, with the error messages it reported.
+type P4Error struct {
+	Command  string
+	Messages []P4Message
+	Err      error
+}
+
+func (e *P4Error) Error() string {
+	var texts []string
+	for _, m := range e.Messages {
+		texts = append(texts, strings.TrimSpace(m.Data))
+	}
+	if len(texts) == 0 {
+		return fmt.Sprintf("p4 %s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("p4 %s: %s", e.Command, strings.Join(texts, "; "))
+}
+
+func (e *P4Error) Unwrap() error {
+	return e.Err
+}
+
+// hasGeneric reports whether any error message has the given generic code.
+func (e *P4Error) hasGeneric(generic int) bool {
+	for _, m := range e.Messages {
+		if m.Generic == generic {
+			return true
+		}
+	}
+	return false
+}
+
+// RunTagged runs a p4 command with -ztag -Mj and parses its output into records and messages.
+// If the command fails or reports an error, the error is a *P4Error.
+func (c *P4Client) RunTagged(dir string, args ...string) (*P4Result, error) {
+	output, runErr := c.run(dir, nil, append([]string{"-ztag", "-Mj"}, args...)...)
+
+	result := &P4Result{}
+	var errs []P4Message
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			// Not JSON, such as a connection error from the client itself
+			message := P4Message{Data: string(line), Severity: P4SeverityInfo}
+			if runErr != nil {
+				message.Severity = P4SeverityFailed
+			}
+			if message.Severity >= P4SeverityFailed {
+				errs = append(errs, message)
+			} else {
+				result.Messages = append(result.Messages, message)
+			}
+			continue
+		}
+		if _, ok := fields["severity"]; ok {
+			var message P4Message
+			json.Unmarshal(line, &message)
+			if message.Severity >= P4SeverityFailed {
+				errs = append(errs, message)
+			} else {
+				result.Messages = append(result.Messages, message)
+			}
+			continue
+		}
+		record := make(P4Record, len(fields))
+		for key, value := range fields {
+			if s, ok := value.(string); ok {
+				record[key] = s
+			} else {
+				record[key] = fmt.Sprint(value)
+			}
+		}
+		result.Records = append(result.Records, record)
+	}
+
+	if runErr != nil || len(errs) > 0 {
+		if runErr == nil {
+			runErr = errors.New("command reported an error")
+		}
+		return result, &P4Error{Command: p4Subcommand(args), Messages: errs, Err: runErr}
+	}
+	return result, nil
+}
+
+// P4OpenedFile is a file opened in the gateway's workspace.
+type P4OpenedFile struct {
+	DepotFile  string
+	ClientFile string
+	Action     string
+	Change     string
+	Type       string
+	Rev        int
+}
+
+// Opened lists the files opened under path.
+func (c *P4Client) Opened(path string) ([]P4OpenedFile, error) {
+	result, err := c.RunTagged("", "opened", path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]P4OpenedFile, 0, len(result.Records))
+	for _, record := range result.Records {
+		rev, _ := strconv.Atoi(record["rev"])
+		files = append(files, P4OpenedFile{
+			DepotFile:  record["depotFile"],
+			ClientFile: record["clientFile"],
+			Action:     record["action"],
+			Change:     record["change"],
+			Type:       record["type"],
+			Rev:        rev,
+		})
+	}
+	return files, nil
+}
+
+// Submit submits the files opened under path and returns the submitted changelist number.
+// It returns ErrNothingToSubmit if no files are opened there.
+func (c *P4Client) Submit(description, path string) (int, error) {
+	result, err := c.RunTagged("", "submit", "-d", description, path)
+	var p4Err *P4Error
+	if errors.As(err, &p4Err) && p4Err.hasGeneric(p4GenericEmpty) {
+		return 0, ErrNothingToSubmit
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, record := range result.Records {
+		if change, ok := record["submittedChange"]; ok {
+			return strconv.Atoi(change)
+		}
+	}
+	return 0, fmt.Errorf("p4 submit: no submitted change number in output")
+}
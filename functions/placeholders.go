@@ -0,0 +1,92 @@
+package functions
+
+import (
+	"strings"
+	"time"
+)
+
+// pathPlaceholders are the placeholders substituted in file_name and directory.
+var pathPlaceholders = []string{"CUSTOMER", "INSTANCE", "USER", "DATE", "YYYY", "MM", "DD", "TAG"}
+
+// tagPlaceholder splits a file config into one file per monitor tag.
+const tagPlaceholder = "%TAG%"
+
+// pathValues are the placeholder values for one push.
+type pathValues map[string]string
+
+func newPathValues(customer, instance, user string, pushTime time.Time) pathValues {
+	return pathValues{
+		"CUSTOMER": customer,
+		"INSTANCE": instance,
+		"USER":     user,
+		"DATE":     pushTime.Format("2006-01-02"),
+		"YYYY":     pushTime.Format("2006"),
+		"MM":       pushTime.Format("01"),
+		"DD":       pushTime.Format("02"),
+	}
+}
+
+// replace substitutes the placeholders in value, with tag standing in for %TAG%.
+func (v pathValues) replace(value, tag string) string {
+	pairs := make([]string, 0, 2*len(pathPlaceholders))
+	for _, name := range pathPlaceholders {
+		replacement := v[name]
+		if name == "TAG" {
+			replacement = tag
+		}
+		pairs = append(pairs, "%"+name+"%", pathSafe(replacement))
+	}
+	return strings.NewReplacer(pairs...).Replace(value)
+}
+
+// fileGroup is a file config with its placeholders substituted and the items going into it.
+type fileGroup struct {
+	fileConfig FileConfig
+	items      []Item
+}
+
+// expand substitutes the placeholders in the file config. A file config using %TAG% becomes
+// one file per distinct monitor tag of its items, in the order the tags were first seen.
+func (v pathValues) expand(fileConfig FileConfig, items []Item) []fileGroup {
+	withValues := func(tag string, items []Item) fileGroup {
+		fc := fileConfig
+		fc.FileName = v.replace(fc.FileName, tag)
+		fc.Directory = v.replace(fc.Directory, tag)
+		return fileGroup{fileConfig: fc, items: items}
+	}
+	if !strings.Contains(fileConfig.FileName, tagPlaceholder) && !strings.Contains(fileConfig.Directory, tagPlaceholder) {
+		return []fileGroup{withValues("", items)}
+	}
+
+	var tags []string
+	byTag := make(map[string][]Item)
+	for _, item := range items {
+		if _, ok := byTag[item.MonitorTag]; !ok {
+			tags = append(tags, item.MonitorTag)
+		}
+		byTag[item.MonitorTag] = append(byTag[item.MonitorTag], item)
+	}
+	groups := make([]fileGroup, 0, len(tags))
+	for _, tag := range tags {
+		groups = append(groups, withValues(tag, byTag[tag]))
+	}
+	return groups
+}
+
+// pathSafe makes a placeholder value usable as a single path element: characters other than
+// letters, digits, '.', '_', '-' and '@' become '_', as does an empty value, "." or "..".
+func pathSafe(value string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '_', r == '-', r == '@':
+			return r
+		}
+		return '_'
+	}, value)
+	if safe == "" || safe == "." || safe == ".." {
+		return "_"
+	}
+	return safe
+}
@@ -0,0 +1,108 @@
+package functions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathSafe(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"acme", "acme"},
+		{"server-1.example.com", "server-1.example.com"},
+		{"user@example.com", "user@example.com"},
+		{"p4 info", "p4_info"},
+		{"Autobot OS_server_info", "Autobot_OS_server_info"},
+		{"a/b", "a_b"},
+		{`a\b`, "a_b"},
+		{"../etc", ".._etc"},
+		{"%INSTANCE%", "_INSTANCE_"},
+		{"héllo", "h_llo"},
+		{"", "_"},
+		{".", "_"},
+		{"..", "_"},
+		{"...", "..."},
+		{"/", "_"},
+	}
+	for _, test := range tests {
+		if got := pathSafe(test.value); got != test.want {
+			t.Errorf("pathSafe(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPathValuesReplace(t *testing.T) {
+	values := newPathValues("acme", "i1", "bob", time.Date(2024, 3, 7, 23, 59, 0, 0, time.UTC))
+	tests := []struct {
+		value string
+		tag   string
+		want  string
+	}{
+		{"servers/%INSTANCE%", "", "servers/i1"},
+		{"%CUSTOMER%/%USER%", "", "acme/bob"},
+		{"history/%YYYY%/%MM%/%DD%", "", "history/2024/03/07"},
+		{"%DATE%.md", "", "2024-03-07.md"},
+		{"%TAG%.md", "p4 info", "p4_info.md"},
+		{"%TAG%.md", "../up", ".._up.md"},
+		{"%TAG%.md", "", "_.md"},
+		{"%INSTANCE%-%INSTANCE%", "", "i1-i1"},
+		{"%instance%/%UNKNOWN%/100%", "", "%instance%/%UNKNOWN%/100%"},
+		{"no placeholders", "", "no placeholders"},
+	}
+	for _, test := range tests {
+		if got := values.replace(test.value, test.tag); got != test.want {
+			t.Errorf("replace(%q, %q) = %q, want %q", test.value, test.tag, got, test.want)
+		}
+	}
+
+	// Values that are not path safe cannot add directories
+	unsafe := newPathValues("../acme", "a/b", "", time.Time{})
+	if got := unsafe.replace("%CUSTOMER%/%INSTANCE%/%USER%", ""); got != ".._acme/a_b/_" {
+		t.Errorf("replace with unsafe values = %q", got)
+	}
+}
+
+func TestPathValuesExpand(t *testing.T) {
+	values := newPathValues("acme", "i1", "bob", time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC))
+	items := []Item{
+		{MonitorTag: "p4 info", Output: "1"},
+		{MonitorTag: "uptime", Output: "2"},
+		{MonitorTag: "p4 info", Output: "3"},
+	}
+	tests := []struct {
+		name      string
+		fileName  string
+		directory string
+		want      []string
+		sizes     []int
+	}{
+		{"no tag", "%INSTANCE%.md", "servers/%YYYY%", []string{"servers/2024/i1.md"}, []int{3}},
+		{"tag in file name", "%TAG%.md", "servers/%INSTANCE%", []string{"servers/i1/p4_info.md", "servers/i1/uptime.md"}, []int{2, 1}},
+		{"tag in directory", "report.md", "tags/%TAG%", []string{"tags/p4_info/report.md", "tags/uptime/report.md"}, []int{2, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups := values.expand(FileConfig{FileName: test.fileName, Directory: test.directory}, items)
+			if len(groups) != len(test.want) {
+				t.Fatalf("got %d groups, want %d", len(groups), len(test.want))
+			}
+			for i, group := range groups {
+				if got := group.fileConfig.Directory + "/" + group.fileConfig.FileName; got != test.want[i] {
+					t.Errorf("group %d is %q, want %q", i, got, test.want[i])
+				}
+				if len(group.items) != test.sizes[i] {
+					t.Errorf("group %d has %d items, want %d", i, len(group.items), test.sizes[i])
+				}
+			}
+		})
+	}
+
+	if groups := values.expand(FileConfig{FileName: "%TAG%.md"}, nil); len(groups) != 0 {
+		t.Errorf("expand per tag with no items = %d groups, want none", len(groups))
+	}
+	if groups := values.expand(FileConfig{FileName: "all.md"}, nil); len(groups) != 1 {
+		t.Errorf("expand with no items = %d groups, want 1", len(groups))
+	}
+}
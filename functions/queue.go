@@ -0,0 +1,199 @@
+package functions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// maxSubmitBackoff caps the delay between retries of a failed submit.
+const maxSubmitBackoff = 30 * time.Minute
+
+var (
+	submitQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "submit_queue_depth",
+		Help:      "Number of customers waiting for a queued submit.",
+	})
+
+	submitRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "submit_retries_total",
+		Help:      "Number of queued submits that failed and were rescheduled, by customer.",
+	}, []string{"customer"})
+
+	submitsAbandoned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "submits_abandoned_total",
+		Help:      "Number of queued submits dropped after exhausting their retries, by customer.",
+	}, []string{"customer"})
+)
+
+// submitJob is the pending submit for one customer, covering every push since the last
+// submit.
+type submitJob struct {
+	customer  string
+	pushes    []SubmitInfo
+	attempts  int
+	notBefore time.Time
+}
+
+// SubmitQueue commits pushes to the store in the background so pushes can be acknowledged as
+// soon as their data is on disk. A single worker serializes all submits, and pushes for a
+// customer that arrive while its submit is still pending are batched into it.
+type SubmitQueue struct {
+	store      VersionedStore
+	retries    int
+	backoff    time.Duration
+	batchDelay time.Duration
+	logger     *logrus.Logger
+
+	mu      sync.Mutex
+	pending map[string]*submitJob
+	order   []string
+	wake    chan struct{}
+}
+
+// NewSubmitQueue creates a queue committing to store. Failed submits are retried up to
+// retries times, starting backoff apart and doubling each time. Each submit waits batchDelay
+// after its first push so that pushes from several instances can share one changelist.
+func NewSubmitQueue(store VersionedStore, retries int, backoff, batchDelay time.Duration, logger *logrus.Logger) *SubmitQueue {
+	return &SubmitQueue{
+		store:      store,
+		retries:    retries,
+		backoff:    backoff,
+		batchDelay: batchDelay,
+		logger:     logger,
+		pending:    make(map[string]*submitJob),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Enqueue schedules a submit of the customer's data for push.
+func (q *SubmitQueue) Enqueue(push SubmitInfo) {
+	q.mu.Lock()
+	job, ok := q.pending[push.Customer]
+	if !ok {
+		job = &submitJob{
+			customer:  push.Customer,
+			notBefore: time.Now().Add(q.batchDelay),
+		}
+		q.pending[push.Customer] = job
+		q.order = append(q.order, push.Customer)
+	}
+	job.pushes = append(job.pushes, push)
+	submitQueueDepth.Set(float64(len(q.pending)))
+	q.mu.Unlock()
+
+	q.logger.Debugf("Queued submit for customer: %s, instance: %s", push.Customer, push.Instance)
+	q.signal()
+}
+
+func (q *SubmitQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes and returns the first job that is due. If none is due it returns how long to
+// wait for the earliest one, or a negative duration if the queue is empty.
+func (q *SubmitQueue) next() (*submitJob, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	wait := time.Duration(-1)
+	for i, customer := range q.order {
+		job := q.pending[customer]
+		if !job.notBefore.After(now) {
+			q.order = append(q.order[:i:i], q.order[i+1:]...)
+			delete(q.pending, customer)
+			submitQueueDepth.Set(float64(len(q.pending)))
+			return job, 0
+		}
+		if d := job.notBefore.Sub(now); wait < 0 || d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+// retryDelay is the wait before retrying a submit that has failed attempts times: backoff,
+// doubled for each earlier attempt and capped at maxSubmitBackoff. A zero backoff retries
+// straight away.
+func retryDelay(backoff time.Duration, attempts int) time.Duration {
+	delay := backoff
+	if delay < 0 {
+		delay = 0
+	}
+	// Stop doubling at the cap so that the delay cannot overflow
+	for i := 1; i < attempts && delay < maxSubmitBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxSubmitBackoff {
+		delay = maxSubmitBackoff
+	}
+	return delay
+}
+
+// requeue puts a failed job back with a delay, merging it with any push that arrived meanwhile.
+func (q *SubmitQueue) requeue(job *submitJob) {
+	delay := retryDelay(q.backoff, job.attempts)
+	job.notBefore = time.Now().Add(delay)
+
+	q.mu.Lock()
+	if existing, ok := q.pending[job.customer]; ok {
+		job.pushes = append(job.pushes, existing.pushes...)
+		q.pending[job.customer] = job
+	} else {
+		q.pending[job.customer] = job
+		q.order = append(q.order, job.customer)
+	}
+	submitQueueDepth.Set(float64(len(q.pending)))
+	q.mu.Unlock()
+
+	q.logger.Warnf("Submit for customer %s failed (attempt %d), retrying in %s", job.customer, job.attempts, delay)
+}
+
+// Run processes the queue until the process exits.
+func (q *SubmitQueue) Run() {
+	for {
+		job, wait := q.next()
+		if job == nil {
+			if wait < 0 {
+				<-q.wake
+				continue
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+		q.submit(job)
+	}
+}
+
+func (q *SubmitQueue) submit(job *submitJob) {
+	job.attempts++
+	unlock := lockCustomerWait(job.customer)
+	_, err := commitCustomer(q.store, job.customer, job.pushes)
+	unlock()
+	if err == nil {
+		return
+	}
+	q.logger.Errorf("Commit error for customer %s: %v", job.customer, err)
+	if job.attempts > q.retries {
+		q.logger.Errorf("Giving up on submit for customer %s after %d attempts", job.customer, job.attempts)
+		submitsAbandoned.WithLabelValues(job.customer).Inc()
+		return
+	}
+	submitRetries.WithLabelValues(job.customer).Inc()
+	q.requeue(job)
+}
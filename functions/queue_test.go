@@ -0,0 +1,33 @@
+package functions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		backoff  time.Duration
+		attempts int
+		want     time.Duration
+	}{
+		{time.Minute, 1, time.Minute},
+		{time.Minute, 2, 2 * time.Minute},
+		{time.Minute, 3, 4 * time.Minute},
+		{time.Minute, 5, 16 * time.Minute},
+		{time.Minute, 6, maxSubmitBackoff},
+		{time.Minute, 0, time.Minute},
+		{time.Minute, 1000, maxSubmitBackoff},
+		{20 * time.Minute, 2, maxSubmitBackoff},
+		{time.Hour, 1, maxSubmitBackoff},
+		{0, 1, 0},
+		{0, 1000, 0},
+		{-time.Minute, 3, 0},
+		{time.Nanosecond, 1000, maxSubmitBackoff},
+	}
+	for _, test := range tests {
+		if got := retryDelay(test.backoff, test.attempts); got != test.want {
+			t.Errorf("retryDelay(%v, %d) = %v, want %v", test.backoff, test.attempts, got, test.want)
+		}
+	}
+}
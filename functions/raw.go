@@ -0,0 +1,208 @@
+package functions
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rawDir is the directory under each customer where accepted /json/ payloads are kept.
+const rawDir = "raw"
+
+// rawPayloads controls whether and how accepted /json/ payloads are kept.
+var rawPayloads struct {
+	enabled  bool
+	compress bool
+	retain   int
+}
+
+// SetRawPayloads enables keeping accepted /json/ payloads, optionally gzip compressed. If retain
+// is positive only that many payloads are kept per instance.
+func SetRawPayloads(enabled, compress bool, retain int) {
+	rawPayloads.enabled = enabled
+	rawPayloads.compress = compress
+	rawPayloads.retain = retain
+}
+
+// SaveRawPayload keeps body under dataDir/customer/raw/instance/ in store, named after the
+// current time, if raw payloads are enabled. It returns the payload file written and the old
+// payloads removed to honour the retain count.
+func SaveRawPayload(store VersionedStore, dataDir, customer, instance string, body []byte) ([]FileResult, error) {
+	if !rawPayloads.enabled {
+		return nil, nil
+	}
+	dir := filepath.Join(dataDir, customer, rawDir, instance)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %v", dir, err)
+	}
+
+	name := time.Now().UTC().Format(snapshotTimeFormat) + ".json"
+	data := body
+	if rawPayloads.compress {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := zw.Write(body); err != nil {
+			return nil, fmt.Errorf("error compressing payload: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing payload: %v", err)
+		}
+		name += ".gz"
+		data = compressed.Bytes()
+	}
+	path := filepath.Join(dir, name)
+	written, err := store.WriteFile(path, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if written {
+		markPending(customer)
+	}
+	files := []FileResult{relativeFile(dataDir, path, written)}
+
+	if rawPayloads.retain > 0 {
+		payloads, err := rawPayloadFiles(dir)
+		if err != nil {
+			return files, err
+		}
+		for len(payloads) > rawPayloads.retain {
+			path := filepath.Join(dir, payloads[0])
+			removed, err := store.RemoveFile(path)
+			if err != nil {
+				return files, fmt.Errorf("error removing old payload: %v", err)
+			}
+			if removed {
+				markPending(customer)
+				file := relativeFile(dataDir, path, true)
+				file.Removed = true
+				files = append(files, file)
+			}
+			payloads = payloads[1:]
+		}
+	}
+	return files, nil
+}
+
+// rawPayloadFiles lists the payload files in dir, oldest first.
+func rawPayloadFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && (strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")) {
+			names = append(names, name)
+		}
+	}
+	// Names start with a sortable timestamp
+	sort.Strings(names)
+	return names, nil
+}
+
+// LatestRawPayloads returns the path of the most recent payload kept for each of the customer's
+// instances.
+func LatestRawPayloads(dataDir, customer string) (map[string]string, error) {
+	dir := filepath.Join(dataDir, customer, rawDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.IsDir() || !validName.MatchString(entry.Name()) {
+			continue
+		}
+		payloads, err := rawPayloadFiles(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(payloads) > 0 {
+			latest[entry.Name()] = filepath.Join(dir, entry.Name(), payloads[len(payloads)-1])
+		}
+	}
+	return latest, nil
+}
+
+// readPayloadFile reads a payload file, decompressing it if its name ends in .gz.
+func readPayloadFile(path string) ([]byte, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return os.ReadFile(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// Rerender rebuilds the customer's files from the latest payload kept for each instance, using
+// the current configuration, and commits the result to the store. The payloads do not record who
+// pushed them, so %USER% is substituted with user. It returns the files that changed and the
+// new revision, which is nil if nothing changed.
+func Rerender(store VersionedStore, dataDir, customer, user string, logger *logrus.Logger) ([]string, *Revision, error) {
+	latest, err := LatestRawPayloads(dataDir, customer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing raw payloads for customer %s: %v", customer, err)
+	}
+	if len(latest) == 0 {
+		return nil, nil, fmt.Errorf("no raw payloads kept for customer %s", customer)
+	}
+
+	unlock, ok := LockCustomer(customer)
+	if !ok {
+		return nil, nil, fmt.Errorf("timed out waiting for lock on customer: %s", customer)
+	}
+	defer unlock()
+
+	instances := make([]string, 0, len(latest))
+	for instance := range latest {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+
+	var changed []string
+	var pushes []SubmitInfo
+	for _, instance := range instances {
+		body, err := readPayloadFile(latest[instance])
+		if err != nil {
+			return nil, nil, err
+		}
+		items, invalid, err := ValidateItems(body)
+		if err != nil || len(invalid) > 0 {
+			logger.Warnf("Skipping invalid raw payload %s", latest[instance])
+			continue
+		}
+		logger.Infof("Rerendering customer: %s, instance: %s from %s", customer, instance, latest[instance])
+		files, err := ProcessDataMap(store, items, dataDir, logger, customer, instance, user)
+		if err != nil {
+			return nil, nil, err
+		}
+		changed = append(changed, joinPaths(dataDir, ChangedPaths(files))...)
+		pushes = append(pushes, SubmitInfo{Customer: customer, Instance: instance, User: user, Files: files, Rerendered: true})
+	}
+	if len(changed) == 0 && !commitPending(customer) {
+		return nil, nil, nil
+	}
+
+	revision, err := commitCustomer(store, customer, pushes)
+	if err != nil {
+		return changed, nil, err
+	}
+	return changed, revision, nil
+}
@@ -0,0 +1,63 @@
+package functions
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reload re-reads the auth and config files. Both files are validated before either is
+// swapped in, so an invalid file leaves the running configuration untouched. A changed
+// applicationConfig replaces the p4 client; storage settings cannot change without a restart.
+func Reload(authFile, configFile string, logger *logrus.Logger) error {
+	auth, err := parseAuthFile(authFile)
+	if err != nil {
+		return err
+	}
+	config, err := parseConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("error loading config file %s: %v", configFile, err)
+	}
+	if config.config.Storage != CurrentConfig().Storage {
+		return fmt.Errorf("storage settings in %s changed; they cannot change without a restart", configFile)
+	}
+	p4Changed := !reflect.DeepEqual(config.config.ApplicationConfig, CurrentConfig().ApplicationConfig)
+	currentAuth.Store(auth)
+	currentConfig.Store(config)
+	if p4Changed {
+		SetP4Client(NewP4Client(config.config.ApplicationConfig, logger))
+		logger.Infof("Perforce settings changed, using p4 %s with P4CONFIG %s", config.config.ApplicationConfig.P4Bin, config.config.ApplicationConfig.P4Config)
+	}
+	logger.Infof("Reloaded %s and %s", authFile, configFile)
+	return nil
+}
+
+// HandleReload serves POST /-/reload for authenticated users not restricted by user_access.
+func HandleReload(w http.ResponseWriter, req *http.Request, logger *logrus.Logger, authFile, configFile string) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := Authenticate(req)
+	if !ok {
+		RecordAuthFailure("reload")
+		w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !AuthorizeAdmin(user) {
+		logger.Warnf("User %s is restricted by user_access and may not reload the configuration", user)
+		RecordAuthFailure("reload")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	logger.Infof("Reload requested by user: %s", user)
+	if err := Reload(authFile, configFile, logger); err != nil {
+		logger.Errorf("Reload failed, keeping current configuration: %v", err)
+		http.Error(w, fmt.Sprintf("Reload failed: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("Configuration reloaded\n"))
+}
@@ -0,0 +1,219 @@
+package functions
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultRenderer is used for file_configs entries that do not name a renderer.
+const DefaultRenderer = "markdown"
+
+// RenderContext is everything a renderer needs to produce one report file.
+type RenderContext struct {
+	Customer string
+	Instance string
+	FileName string
+	PushTime time.Time
+	// Items are the items with output for this file, in monitor_tags order.
+	Items []Item
+}
+
+// DecodedOutput returns the item's output decoded from base64.
+func (i Item) DecodedOutput() string {
+	decoded, err := base64.StdEncoding.DecodeString(i.Output)
+	if err != nil {
+		return ""
+	}
+	return string(decoded)
+}
+
+// Renderer formats the items of a report file.
+type Renderer interface {
+	// Extension is the file name extension, including the leading dot.
+	Extension() string
+	// Render writes the file content for ctx to w.
+	Render(w io.Writer, ctx *RenderContext) error
+}
+
+var renderers = map[string]Renderer{
+	"markdown": markdownRenderer{},
+	"html":     htmlRenderer{},
+	"json":     jsonRenderer{},
+	"text":     textRenderer{},
+}
+
+// RegisterRenderer makes a renderer available to file_configs under name.
+// It must be called before the config file is loaded.
+func RegisterRenderer(name string, renderer Renderer) {
+	renderers[name] = renderer
+}
+
+// RendererNames lists the registered renderer names.
+func RendererNames() []string {
+	names := make([]string, 0, len(renderers))
+	for name := range renderers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupRenderer returns the named renderer, or the default one for an empty name.
+func lookupRenderer(name string) (Renderer, error) {
+	if name == "" {
+		name = DefaultRenderer
+	}
+	renderer, ok := renderers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown renderer %q (available: %v)", name, RendererNames())
+	}
+	return renderer, nil
+}
+
+type markdownRenderer struct{}
+
+func (markdownRenderer) Extension() string { return ".md" }
+
+func (markdownRenderer) Render(w io.Writer, ctx *RenderContext) error {
+	for _, item := range ctx.Items {
+		if _, err := fmt.Fprintf(w, "# %s\n```\n%s\n```\n", item.Description, item.DecodedOutput()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type htmlRenderer struct{}
+
+func (htmlRenderer) Extension() string { return ".html" }
+
+func (htmlRenderer) Render(w io.Writer, ctx *RenderContext) error {
+	title := html.EscapeString(fmt.Sprintf("%s - %s - %s", ctx.Customer, ctx.Instance, ctx.FileName))
+	if _, err := fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n", title, title); err != nil {
+		return err
+	}
+	for _, item := range ctx.Items {
+		if _, err := fmt.Fprintf(w, "<h2>%s</h2>\n<pre>%s</pre>\n", html.EscapeString(item.Description), html.EscapeString(item.DecodedOutput())); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprint(w, "</body>\n</html>\n")
+	return err
+}
+
+type jsonRenderer struct{}
+
+func (jsonRenderer) Extension() string { return ".json" }
+
+// jsonReportItem is an item as written by the json renderer, with its output decoded.
+type jsonReportItem struct {
+	MonitorTag  string     `json:"monitor_tag"`
+	Description string     `json:"description"`
+	Output      string     `json:"output"`
+	Command     string     `json:"command,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	StartTime   *time.Time `json:"start_time,omitempty"`
+	EndTime     *time.Time `json:"end_time,omitempty"`
+}
+
+func (jsonRenderer) Render(w io.Writer, ctx *RenderContext) error {
+	report := struct {
+		Customer string           `json:"customer"`
+		Instance string           `json:"instance"`
+		Items    []jsonReportItem `json:"items"`
+	}{
+		Customer: ctx.Customer,
+		Instance: ctx.Instance,
+		Items:    make([]jsonReportItem, 0, len(ctx.Items)),
+	}
+	for _, item := range ctx.Items {
+		report.Items = append(report.Items, jsonReportItem{
+			MonitorTag:  item.MonitorTag,
+			Description: item.Description,
+			Output:      item.DecodedOutput(),
+			Command:     item.Command,
+			ExitCode:    item.ExitCode,
+			StartTime:   item.StartTime,
+			EndTime:     item.EndTime,
+		})
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+type textRenderer struct{}
+
+func (textRenderer) Extension() string { return ".txt" }
+
+func (textRenderer) Render(w io.Writer, ctx *RenderContext) error {
+	for _, item := range ctx.Items {
+		if _, err := fmt.Fprintf(w, "== %s ==\n%s\n\n", item.Description, item.DecodedOutput()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateFuncs are available to user-defined templates in addition to the text/template builtins.
+var templateFuncs = template.FuncMap{
+	"anchor": markdownAnchor,
+	"lower":  strings.ToLower,
+	"upper":  strings.ToUpper,
+	"trim":   strings.TrimSpace,
+	"join":   strings.Join,
+}
+
+var anchorStrip = regexp.MustCompile(`[^a-z0-9 _-]`)
+
+// markdownAnchor returns the GitHub-style anchor for a Markdown heading, for tables of contents.
+func markdownAnchor(heading string) string {
+	anchor := anchorStrip.ReplaceAllString(strings.ToLower(strings.TrimSpace(heading)), "")
+	return strings.ReplaceAll(anchor, " ", "-")
+}
+
+// templateRenderer renders a file config's user-defined template, keeping the file extension of
+// the renderer it replaces.
+type templateRenderer struct {
+	extension string
+	tmpl      *template.Template
+}
+
+func (r templateRenderer) Extension() string { return r.extension }
+
+func (r templateRenderer) Render(w io.Writer, ctx *RenderContext) error {
+	return r.tmpl.Execute(w, ctx)
+}
+
+// parseFileTemplate parses a file config's template. A value containing "{{" or a newline is the
+// template itself; anything else is the path of a template file, relative to configDir.
+func parseFileTemplate(name, value, configDir string) (*template.Template, error) {
+	text := value
+	if !strings.Contains(value, "{{") && !strings.Contains(value, "\n") {
+		path := value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(configDir, path)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading template file: %v", err)
+		}
+		text = string(content)
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %v", err)
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,171 @@
+package functions
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Push statuses reported in PushResponse.
+const (
+	PushCommitted = "committed"
+	PushQueued    = "queued"
+	PushUnchanged = "unchanged"
+	PushNoChanges = "no changes"
+	PushFailed    = "failed"
+)
+
+// FileResult is one file produced by a push.
+type FileResult struct {
+	// Path is relative to the data directory.
+	Path    string `json:"path"`
+	Changed bool   `json:"changed"`
+	// Removed is set for a file removed because all of the push's items for it had empty output.
+	Removed bool `json:"removed,omitempty"`
+	// MonitorTags are the tags of the items rendered into the file.
+	MonitorTags []string `json:"monitor_tags,omitempty"`
+}
+
+// ChangedPaths returns the paths of the files that changed.
+func ChangedPaths(files []FileResult) []string {
+	var changed []string
+	for _, file := range files {
+		if file.Changed {
+			changed = append(changed, file.Path)
+		}
+	}
+	return changed
+}
+
+// joinPaths returns paths, relative to dir, joined with dir.
+func joinPaths(dir string, paths []string) []string {
+	joined := make([]string, 0, len(paths))
+	for _, path := range paths {
+		joined = append(joined, filepath.Join(dir, filepath.FromSlash(path)))
+	}
+	return joined
+}
+
+// PushTiming is how long the stages of a push took, in seconds.
+type PushTiming struct {
+	LockWaitSeconds float64 `json:"lock_wait_seconds"`
+	RenderSeconds   float64 `json:"render_seconds"`
+	CommitSeconds   float64 `json:"commit_seconds"`
+	TotalSeconds    float64 `json:"total_seconds"`
+}
+
+// PushResponse is the JSON body answering a push to /json/ or /data/.
+type PushResponse struct {
+	Customer string       `json:"customer"`
+	Instance string       `json:"instance"`
+	Files    []FileResult `json:"files"`
+	// Status is committed, queued, unchanged (nothing written, so no commit was run),
+	// "no changes" (the commit found nothing to record) or failed.
+	Status string `json:"status"`
+	// Revision is the submitted changelist number, or the commit or snapshot ID of the other
+	// storage backends.
+	Revision string     `json:"revision,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Timing   PushTiming `json:"timing"`
+
+	user        string
+	clientAddr  string
+	changedTags []string
+	tagDigests  map[string]tagDigest
+	start       time.Time
+	stage       time.Time
+}
+
+// NewPushResponse starts timing a push by user for customer and instance, received in req at
+// start and about to wait for the customer lock.
+func NewPushResponse(req *http.Request, customer, instance, user string, start time.Time) *PushResponse {
+	return &PushResponse{
+		Customer:   customer,
+		Instance:   instance,
+		Files:      []FileResult{},
+		user:       user,
+		clientAddr: clientAddr(req),
+		start:      start,
+		stage:      time.Now(),
+	}
+}
+
+// lap returns the seconds since the previous stage ended.
+func (r *PushResponse) lap() float64 {
+	now := time.Now()
+	seconds := now.Sub(r.stage).Seconds()
+	r.stage = now
+	return seconds
+}
+
+// Locked records that the push holds the customer lock.
+func (r *PushResponse) Locked() {
+	r.Timing.LockWaitSeconds = r.lap()
+}
+
+// Rendered records the files written by the push.
+func (r *PushResponse) Rendered(files []FileResult) {
+	r.Timing.RenderSeconds = r.lap()
+	if files != nil {
+		r.Files = files
+	}
+}
+
+// FinishPush commits the files changed by a push, or left over from a commit that failed, and
+// answers the push with resp. When queue is non-nil the commit is handed to it.
+func FinishPush(w http.ResponseWriter, store VersionedStore, queue *SubmitQueue, resp *PushResponse, logger *logrus.Logger) {
+	push := SubmitInfo{
+		Customer:    resp.Customer,
+		Instance:    resp.Instance,
+		User:        resp.user,
+		ClientAddr:  resp.clientAddr,
+		Files:       resp.Files,
+		ChangedTags: resp.changedTags,
+		digests:     resp.tagDigests,
+	}
+	if !commitPending(resp.Customer) {
+		// Nothing is left to commit, so the push's items are as good as committed
+		recordTags([]SubmitInfo{push})
+		logger.Infof("No changes for customer: %s, instance: %s", resp.Customer, resp.Instance)
+		resp.Status = PushUnchanged
+		resp.write(w, http.StatusOK)
+		return
+	}
+
+	revision, err := CommitPush(store, queue, push)
+	resp.Timing.CommitSeconds = resp.lap()
+	switch {
+	case err != nil:
+		logger.Errorf("Commit error: %v", err)
+		resp.Status = PushFailed
+		resp.Error = "Error committing data"
+		resp.write(w, http.StatusInternalServerError)
+		return
+	case queue != nil:
+		resp.Status = PushQueued
+	case revision != nil:
+		resp.Status = PushCommitted
+		resp.Revision = revision.ID
+	default:
+		resp.Status = PushNoChanges
+	}
+	resp.write(w, http.StatusOK)
+}
+
+func (r *PushResponse) write(w http.ResponseWriter, status int) {
+	r.Timing.TotalSeconds = time.Since(r.start).Seconds()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(r)
+}
+
+// relativeFile returns the file result for path, relative to dataDir.
+func relativeFile(dataDir, path string, changed bool) FileResult {
+	if rel, err := filepath.Rel(dataDir, path); err == nil {
+		path = rel
+	}
+	return FileResult{Path: filepath.ToSlash(path), Changed: changed}
+}
@@ -0,0 +1,155 @@
+package functions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Item is one command-runner result pushed to /json/.
+type Item struct {
+	MonitorTag  string `json:"monitor_tag"`
+	Description string `json:"description"`
+	// Output is the base64 encoded command output.
+	Output    string     `json:"output"`
+	Command   string     `json:"command,omitempty"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+}
+
+// ItemErrors lists the schema violations of one item in a /json/ push.
+type ItemErrors struct {
+	Index  int      `json:"index"`
+	Errors []string `json:"errors"`
+}
+
+// itemField describes one property of the item schema.
+type itemField struct {
+	name     string
+	required bool
+	// check validates the raw JSON value, returning a description of the problem or "".
+	check func(raw json.RawMessage) string
+}
+
+var itemSchema = []itemField{
+	{name: "monitor_tag", required: true, check: checkNonEmptyString},
+	{name: "description", required: true, check: checkString},
+	{name: "output", required: true, check: checkBase64},
+	{name: "command", check: checkString},
+	{name: "exit_code", check: checkInteger},
+	{name: "start_time", check: checkTimestamp},
+	{name: "end_time", check: checkTimestamp},
+}
+
+func checkString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return "must be a string"
+	}
+	return ""
+}
+
+func checkNonEmptyString(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return "must be a string"
+	}
+	if s == "" {
+		return "must not be empty"
+	}
+	return ""
+}
+
+func checkBase64(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return "must be a string"
+	}
+	if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+		return "must be base64 encoded"
+	}
+	return ""
+}
+
+func checkInteger(raw json.RawMessage) string {
+	var i int
+	if json.Unmarshal(raw, &i) != nil {
+		return "must be an integer"
+	}
+	return ""
+}
+
+func checkTimestamp(raw json.RawMessage) string {
+	var t time.Time
+	if json.Unmarshal(raw, &t) != nil {
+		return "must be an RFC 3339 timestamp"
+	}
+	return ""
+}
+
+// ValidateItems checks a /json/ body against the item schema. It returns the decoded items,
+// or the violations of every invalid item. A body that is not valid JSON returns an error.
+func ValidateItems(body []byte) ([]Item, []ItemErrors, error) {
+	var rawItems []json.RawMessage
+	if err := json.Unmarshal(body, &rawItems); err != nil {
+		var v interface{}
+		if json.Unmarshal(body, &v) != nil {
+			return nil, nil, err
+		}
+		return nil, []ItemErrors{{Index: -1, Errors: []string{"body must be an array of items"}}}, nil
+	}
+
+	items := make([]Item, 0, len(rawItems))
+	var invalid []ItemErrors
+	for i, raw := range rawItems {
+		var fields map[string]json.RawMessage
+		if json.Unmarshal(raw, &fields) != nil || fields == nil {
+			invalid = append(invalid, ItemErrors{Index: i, Errors: []string{"item must be an object"}})
+			continue
+		}
+		var errs []string
+		for _, field := range itemSchema {
+			value, ok := fields[field.name]
+			if !ok || bytes.Equal(value, []byte("null")) {
+				if field.required {
+					errs = append(errs, fmt.Sprintf("%s: is required", field.name))
+				}
+				continue
+			}
+			if problem := field.check(value); problem != "" {
+				errs = append(errs, fmt.Sprintf("%s: %s", field.name, problem))
+			}
+		}
+		if len(errs) > 0 {
+			invalid = append(invalid, ItemErrors{Index: i, Errors: errs})
+			continue
+		}
+		var item Item
+		if err := json.Unmarshal(raw, &item); err != nil {
+			invalid = append(invalid, ItemErrors{Index: i, Errors: []string{err.Error()}})
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(invalid) > 0 {
+		return nil, invalid, nil
+	}
+	return items, nil, nil
+}
+
+// RespondInvalidItems rejects a push with 422 and the per-item schema violations.
+func RespondInvalidItems(w http.ResponseWriter, invalid []ItemErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(struct {
+		Error string       `json:"error"`
+		Items []ItemErrors `json:"items"`
+	}{
+		Error: "JSON data does not match the item schema",
+		Items: invalid,
+	})
+}
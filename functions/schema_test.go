@@ -0,0 +1,137 @@
+package functions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateItems(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		items   int
+		invalid []ItemErrors
+	}{
+		{
+			name:  "minimal item",
+			body:  `[{"monitor_tag":"p4 info","description":"Server info","output":"aGVsbG8="}]`,
+			items: 1,
+		},
+		{
+			name: "all fields",
+			body: `[{"monitor_tag":"p4 info","description":"","output":"","command":"p4 info","exit_code":0,
+				"start_time":"2024-01-02T03:04:05Z","end_time":"2024-01-02T03:04:06+01:00"}]`,
+			items: 1,
+		},
+		{
+			name:  "null optional fields",
+			body:  `[{"monitor_tag":"p4 info","description":"d","output":"","exit_code":null,"start_time":null}]`,
+			items: 1,
+		},
+		{
+			name:  "unknown fields are ignored",
+			body:  `[{"monitor_tag":"p4 info","description":"d","output":"","extra":[1,2]}]`,
+			items: 1,
+		},
+		{
+			name: "empty array",
+			body: `[]`,
+		},
+		{
+			name:    "not an array",
+			body:    `{"monitor_tag":"p4 info"}`,
+			invalid: []ItemErrors{{Index: -1, Errors: []string{"body must be an array of items"}}},
+		},
+		{
+			name:    "item not an object",
+			body:    `[{"monitor_tag":"p4 info","description":"d","output":""},"p4 info",null]`,
+			invalid: []ItemErrors{{Index: 1, Errors: []string{"item must be an object"}}, {Index: 2, Errors: []string{"item must be an object"}}},
+		},
+		{
+			name: "missing required fields",
+			body: `[{}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{
+				"monitor_tag: is required", "description: is required", "output: is required",
+			}}},
+		},
+		{
+			name:    "null required field",
+			body:    `[{"monitor_tag":null,"description":"d","output":""}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{"monitor_tag: is required"}}},
+		},
+		{
+			name:    "empty monitor tag",
+			body:    `[{"monitor_tag":"","description":"d","output":""}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{"monitor_tag: must not be empty"}}},
+		},
+		{
+			name: "wrong types",
+			body: `[{"monitor_tag":42,"description":["d"],"output":"","command":true,"exit_code":"1"}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{
+				"monitor_tag: must be a string", "description: must be a string", "command: must be a string", "exit_code: must be an integer",
+			}}},
+		},
+		{
+			name:    "fractional exit code",
+			body:    `[{"monitor_tag":"t","description":"d","output":"","exit_code":1.5}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{"exit_code: must be an integer"}}},
+		},
+		{
+			name:    "bad base64",
+			body:    `[{"monitor_tag":"t","description":"d","output":"not base64!"}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{"output: must be base64 encoded"}}},
+		},
+		{
+			name: "bad timestamps",
+			body: `[{"monitor_tag":"t","description":"d","output":"","start_time":"2024-01-02 03:04:05","end_time":1704164645}]`,
+			invalid: []ItemErrors{{Index: 0, Errors: []string{
+				"start_time: must be an RFC 3339 timestamp", "end_time: must be an RFC 3339 timestamp",
+			}}},
+		},
+		{
+			name:    "only invalid items are listed",
+			body:    `[{"monitor_tag":"t","description":"d","output":""},{"monitor_tag":"t","description":"d"}]`,
+			invalid: []ItemErrors{{Index: 1, Errors: []string{"output: is required"}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			items, invalid, err := ValidateItems([]byte(test.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(invalid, test.invalid) {
+				t.Errorf("got invalid %+v, want %+v", invalid, test.invalid)
+			}
+			if len(items) != test.items {
+				t.Errorf("got %d items, want %d", len(items), test.items)
+			}
+		})
+	}
+}
+
+func TestValidateItemsDecodes(t *testing.T) {
+	items, invalid, err := ValidateItems([]byte(`[{"monitor_tag":"p4 info","description":"Server info",
+		"output":"aGVsbG8=","exit_code":2,"start_time":"2024-01-02T03:04:05Z"}]`))
+	if err != nil || invalid != nil {
+		t.Fatalf("ValidateItems = %v, %v", invalid, err)
+	}
+	item := items[0]
+	if item.MonitorTag != "p4 info" || item.Description != "Server info" || item.Output != "aGVsbG8=" {
+		t.Errorf("got item %+v", item)
+	}
+	if item.ExitCode == nil || *item.ExitCode != 2 {
+		t.Errorf("got exit code %v, want 2", item.ExitCode)
+	}
+	if item.StartTime == nil || item.StartTime.Unix() != 1704164645 || item.EndTime != nil {
+		t.Errorf("got times %v, %v", item.StartTime, item.EndTime)
+	}
+}
+
+func TestValidateItemsInvalidJSON(t *testing.T) {
+	for _, body := range []string{``, `[`, `[{"monitor_tag":}]`, `not json`} {
+		if _, _, err := ValidateItems([]byte(body)); err == nil {
+			t.Errorf("ValidateItems(%q) succeeded, want an error", body)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package functions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Storage types selectable with storage.type in config.yaml.
+const (
+	StorageP4         = "p4"
+	StorageGit        = "git"
+	StorageFilesystem = "filesystem"
+)
+
+// storageOverride, when set, replaces storage.type from config.yaml.
+var storageOverride string
+
+// SetStorageType overrides the storage type configured in config.yaml.
+func SetStorageType(storageType string) {
+	storageOverride = storageType
+}
+
+// StorageConfig selects and configures the backend that versions pushed data.
+type StorageConfig struct {
+	Type string    `yaml:"type"`
+	Git  GitConfig `yaml:"git"`
+}
+
+// Revision is one recorded version of a customer's data.
+type Revision struct {
+	// ID is the changelist number or commit hash. It may be empty if the backend could not tell.
+	ID          string    `json:"id"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user,omitempty"`
+	Description string    `json:"description"`
+}
+
+// VersionedStore persists rendered files in a working tree under the data directory and
+// records each push's changes as a revision.
+type VersionedStore interface {
+	// WriteFile writes data to path unless the file already holds the same content, ignoring
+	// lines matching the volatile patterns. It reports whether the file was written.
+	WriteFile(path string, data []byte, volatile []*regexp.Regexp) (bool, error)
+	// RemoveFile removes path, reporting whether there was a file to remove.
+	RemoveFile(path string) (bool, error)
+	// Commit records all outstanding changes under the customer's directory. It returns nil
+	// if there was nothing to commit.
+	Commit(customer, message string) (*Revision, error)
+	// History lists up to max of the most recent revisions for the customer, newest first.
+	History(customer string, max int) ([]Revision, error)
+}
+
+// NewStore creates the storage backend selected in the config for dataDir.
+func NewStore(config *Config, dataDir string, logger *logrus.Logger) (VersionedStore, error) {
+	switch config.Storage.Type {
+	case StorageP4:
+		return NewP4Store(dataDir, logger), nil
+	case StorageGit:
+		return NewGitStore(dataDir, config.Storage.Git, logger)
+	case StorageFilesystem:
+		return NewFilesystemStore(dataDir, logger), nil
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", config.Storage.Type)
+	}
+}
+
+// workingTree implements the file operations shared by all stores.
+type workingTree struct{}
+
+func (workingTree) WriteFile(path string, data []byte, volatile []*regexp.Regexp) (bool, error) {
+	return writeFileIfChanged(path, data, volatile)
+}
+
+func (workingTree) RemoveFile(path string) (bool, error) {
+	err := os.Remove(path)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// committed records the customers whose working tree is known to hold no uncommitted changes.
+// Customers not seen since the gateway started are assumed to have some, so that files left by
+// a commit that failed before a restart are still committed.
+var committed = struct {
+	sync.Mutex
+	customers map[string]bool
+}{customers: make(map[string]bool)}
+
+// markPending records that the customer's working tree has changes to commit. It is called as
+// each file is written or removed, so that a push failing partway still leaves them pending.
+func markPending(customer string) {
+	committed.Lock()
+	delete(committed.customers, customer)
+	committed.Unlock()
+}
+
+// commitPending reports whether the customer's working tree may hold changes to commit, because
+// a push changed files or an earlier commit failed.
+func commitPending(customer string) bool {
+	committed.Lock()
+	defer committed.Unlock()
+	return !committed.customers[customer]
+}
+
+// commitCustomer commits the customer's outstanding changes with the description of pushes
+// and, if that succeeds, records that none are left and what the pushes contained. The caller
+// must hold the customer lock.
+func commitCustomer(store VersionedStore, customer string, pushes []SubmitInfo) (*Revision, error) {
+	revision, err := store.Commit(customer, submitDescription(customer, pushes))
+	if err == nil {
+		committed.Lock()
+		committed.customers[customer] = true
+		committed.Unlock()
+		recordTags(pushes)
+	}
+	return revision, err
+}
+
+// CommitPush records a push's changes, either straight away or through the queue when one is
+// configured. It returns the new revision, or nil if the commit was queued or nothing changed.
+func CommitPush(store VersionedStore, queue *SubmitQueue, push SubmitInfo) (*Revision, error) {
+	if queue != nil {
+		queue.Enqueue(push)
+		return nil, nil
+	}
+	return commitCustomer(store, push.Customer, []SubmitInfo{push})
+}
+
+// HandleHistory serves GET /history/?customer=X[&max=N], listing recent revisions for a customer.
+func HandleHistory(w http.ResponseWriter, req *http.Request, logger *logrus.Logger, store VersionedStore) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := Authenticate(req)
+	if !ok {
+		RecordAuthFailure("history")
+		w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := req.URL.Query()
+	customer := query.Get("customer")
+	if customer == "" || !validName.MatchString(customer) {
+		http.Error(w, "Invalid or missing customer name", http.StatusBadRequest)
+		return
+	}
+	if !AuthorizeCustomer(user, customer) {
+		logger.Warnf("User %s is not authorized for customer: %s", user, customer)
+		RecordAuthFailure("history")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	max := 20
+	if m := query.Get("max"); m != "" {
+		n, err := strconv.Atoi(m)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid max", http.StatusBadRequest)
+			return
+		}
+		max = n
+	}
+
+	revisions, err := store.History(customer, max)
+	if err != nil {
+		logger.Errorf("Error listing history for customer %s: %v", customer, err)
+		http.Error(w, "Failed to list history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
@@ -0,0 +1,185 @@
+package functions
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// historyDir is the directory under each customer where filesystem snapshots are kept.
+const historyDir = ".history"
+
+// snapshotTimeFormat names snapshot directories so that they sort chronologically.
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+// descriptionFile holds the message of a snapshot.
+const descriptionFile = "DESCRIPTION"
+
+// FilesystemStore keeps data on the local filesystem only. Each commit copies the files changed
+// since the previous commit into a timestamped snapshot under dataDir/customer/.history/.
+type FilesystemStore struct {
+	dataDir string
+	logger  *logrus.Logger
+
+	mu      sync.Mutex
+	changed map[string]map[string]bool // customer -> changed paths relative to the customer directory
+	removed map[string]map[string]bool
+}
+
+// NewFilesystemStore creates a store keeping snapshots under dataDir.
+func NewFilesystemStore(dataDir string, logger *logrus.Logger) *FilesystemStore {
+	return &FilesystemStore{
+		dataDir: dataDir,
+		logger:  logger,
+		changed: make(map[string]map[string]bool),
+		removed: make(map[string]map[string]bool),
+	}
+}
+
+// split returns the customer and the path relative to the customer directory for path.
+func (s *FilesystemStore) split(path string) (string, string, error) {
+	rel, err := filepath.Rel(s.dataDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", "", fmt.Errorf("%s is outside the data directory %s", path, s.dataDir)
+	}
+	parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("%s is not inside a customer directory", path)
+	}
+	return parts[0], filepath.FromSlash(parts[1]), nil
+}
+
+func (s *FilesystemStore) record(set map[string]map[string]bool, customer, rel string) {
+	if set[customer] == nil {
+		set[customer] = make(map[string]bool)
+	}
+	set[customer][rel] = true
+}
+
+// WriteFile writes the file and remembers it for the next snapshot.
+func (s *FilesystemStore) WriteFile(path string, data []byte, volatile []*regexp.Regexp) (bool, error) {
+	customer, rel, err := s.split(path)
+	if err != nil {
+		return false, err
+	}
+	written, err := writeFileIfChanged(path, data, volatile)
+	if err != nil || !written {
+		return written, err
+	}
+	s.mu.Lock()
+	s.record(s.changed, customer, rel)
+	delete(s.removed[customer], rel)
+	s.mu.Unlock()
+	return true, nil
+}
+
+// RemoveFile removes the file and remembers the removal for the next snapshot.
+func (s *FilesystemStore) RemoveFile(path string) (bool, error) {
+	customer, rel, err := s.split(path)
+	if err != nil {
+		return false, err
+	}
+	removed, err := workingTree{}.RemoveFile(path)
+	if err != nil || !removed {
+		return removed, err
+	}
+	s.mu.Lock()
+	s.record(s.removed, customer, rel)
+	delete(s.changed[customer], rel)
+	s.mu.Unlock()
+	return true, nil
+}
+
+// Commit copies the files changed since the last commit into a new snapshot.
+func (s *FilesystemStore) Commit(customer, message string) (*Revision, error) {
+	s.mu.Lock()
+	changed, removed := s.changed[customer], s.removed[customer]
+	delete(s.changed, customer)
+	delete(s.removed, customer)
+	s.mu.Unlock()
+
+	if len(changed) == 0 && len(removed) == 0 {
+		s.logger.Info("No changes to snapshot.")
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	id := now.Format(snapshotTimeFormat)
+	snapshotDir := filepath.Join(s.dataDir, customer, historyDir, id)
+	restore := func(err error) (*Revision, error) {
+		// Keep the changes pending so that the next commit includes them
+		s.mu.Lock()
+		for rel := range changed {
+			s.record(s.changed, customer, rel)
+		}
+		for rel := range removed {
+			s.record(s.removed, customer, rel)
+		}
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	for rel := range changed {
+		data, err := os.ReadFile(filepath.Join(s.dataDir, customer, rel))
+		if err != nil {
+			return restore(fmt.Errorf("error reading %s for snapshot: %v", rel, err))
+		}
+		target := filepath.Join(snapshotDir, rel)
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			return restore(fmt.Errorf("error creating directory %s: %v", filepath.Dir(target), err))
+		}
+		if err := writeFileAtomic(target, data); err != nil {
+			return restore(err)
+		}
+	}
+
+	description := message + "\n"
+	if len(removed) > 0 {
+		paths := make([]string, 0, len(removed))
+		for rel := range removed {
+			paths = append(paths, filepath.ToSlash(rel))
+		}
+		sort.Strings(paths)
+		description += "\nRemoved:\n" + strings.Join(paths, "\n") + "\n"
+	}
+	if err := os.MkdirAll(snapshotDir, os.ModePerm); err != nil {
+		return restore(fmt.Errorf("error creating directory %s: %v", snapshotDir, err))
+	}
+	if err := writeFileAtomic(filepath.Join(snapshotDir, descriptionFile), []byte(description)); err != nil {
+		return restore(err)
+	}
+
+	s.logger.Infof("Saved snapshot %s for customer %s", id, customer)
+	return &Revision{ID: id, Time: now, Description: message}, nil
+}
+
+// History lists the most recent snapshots for the customer.
+func (s *FilesystemStore) History(customer string, max int) ([]Revision, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dataDir, customer, historyDir))
+	if os.IsNotExist(err) {
+		return []Revision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]Revision, 0)
+	for i := len(entries) - 1; i >= 0 && len(revisions) < max; i-- {
+		entry := entries[i]
+		t, err := time.Parse(snapshotTimeFormat, entry.Name())
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		description, _ := os.ReadFile(filepath.Join(s.dataDir, customer, historyDir, entry.Name(), descriptionFile))
+		firstLine := strings.SplitN(string(description), "\n", 2)[0]
+		revisions = append(revisions, Revision{ID: entry.Name(), Time: t, Description: firstLine})
+	}
+	return revisions, nil
+}
@@ -0,0 +1,142 @@
+package functions
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// GitConfig configures the git storage backend.
+type GitConfig struct {
+	// Bin is the git executable, "git" on the PATH by default.
+	Bin string `yaml:"bin"`
+	// Remote, if set, is pushed to after every commit.
+	Remote string `yaml:"remote"`
+	// Branch is the branch committed to and pushed. The repository's current branch by default.
+	Branch      string `yaml:"branch"`
+	AuthorName  string `yaml:"author_name"`
+	AuthorEmail string `yaml:"author_email"`
+}
+
+// GitStore versions data in a local Git repository rooted at the data directory, with one
+// commit per push and an optional push to a remote.
+type GitStore struct {
+	workingTree
+	dataDir string
+	config  GitConfig
+	logger  *logrus.Logger
+
+	// mu serializes commits, as all customers share the repository index
+	mu          sync.Mutex
+	pushPending bool
+}
+
+// NewGitStore opens the repository at dataDir, initialising it if needed.
+func NewGitStore(dataDir string, config GitConfig, logger *logrus.Logger) (*GitStore, error) {
+	if config.Bin == "" {
+		config.Bin = "git"
+	}
+	if config.AuthorName == "" {
+		config.AuthorName = "datapushgateway"
+	}
+	if config.AuthorEmail == "" {
+		config.AuthorEmail = "datapushgateway@localhost"
+	}
+	s := &GitStore{dataDir: dataDir, config: config, logger: logger}
+
+	if err := os.MkdirAll(dataDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %v", dataDir, err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, ".git")); os.IsNotExist(err) {
+		logger.Infof("Initialising git repository in %s", dataDir)
+		if _, err := s.git("init", "-q"); err != nil {
+			return nil, err
+		}
+		if config.Branch != "" {
+			if _, err := s.git("symbolic-ref", "HEAD", "refs/heads/"+config.Branch); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *GitStore) git(args ...string) (string, error) {
+	cmdArgs := append([]string{
+		"-C", s.dataDir,
+		"-c", "user.name=" + s.config.AuthorName,
+		"-c", "user.email=" + s.config.AuthorEmail,
+	}, args...)
+	s.logger.Debugf("Executing git command: %s %v", s.config.Bin, cmdArgs)
+	output, err := exec.Command(s.config.Bin, cmdArgs...).CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("git %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// Commit stages and commits the customer's directory, then pushes if a remote is configured.
+func (s *GitStore) Commit(customer, message string) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.git("add", "-A", "--", customer); err != nil {
+		return nil, err
+	}
+	var revision *Revision
+	if _, err := s.git("diff", "--cached", "--quiet", "--", customer); err != nil {
+		if _, err := s.git("commit", "-q", "-m", message, "--", customer); err != nil {
+			return nil, err
+		}
+		hash, err := s.git("rev-parse", "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		revision = &Revision{ID: strings.TrimSpace(hash), Time: time.Now(), User: s.config.AuthorName, Description: message}
+		s.logger.Infof("Committed %s for customer %s", revision.ID, customer)
+		s.pushPending = true
+	} else {
+		s.logger.Info("No changes to commit.")
+	}
+
+	if s.config.Remote != "" && s.pushPending {
+		ref := "HEAD"
+		if s.config.Branch != "" {
+			ref = "HEAD:refs/heads/" + s.config.Branch
+		}
+		if _, err := s.git("push", "-q", s.config.Remote, ref); err != nil {
+			return revision, err
+		}
+		s.pushPending = false
+	}
+	return revision, nil
+}
+
+// History lists the most recent commits touching the customer's directory.
+func (s *GitStore) History(customer string, max int) ([]Revision, error) {
+	output, err := s.git("log", "-n", strconv.Itoa(max), "--format=%H%x1f%at%x1f%an%x1f%s", "--", customer)
+	if err != nil {
+		// A repository without commits has no history yet
+		if _, headErr := s.git("rev-parse", "--verify", "-q", "HEAD"); headErr != nil {
+			return []Revision{}, nil
+		}
+		return nil, err
+	}
+	revisions := make([]Revision, 0)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		secs, _ := strconv.ParseInt(fields[1], 10, 64)
+		revisions = append(revisions, Revision{ID: fields[0], Time: time.Unix(secs, 0), User: fields[2], Description: fields[3]})
+	}
+	return revisions, nil
+}
@@ -0,0 +1,59 @@
+package functions
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// P4Store versions data in a Perforce workspace rooted at the data directory. It runs p4 with
+// the current client, so that reloaded settings apply to the next command.
+type P4Store struct {
+	workingTree
+	dataDir string
+	logger  *logrus.Logger
+	// mu serializes submits, as all customers share the workspace
+	mu sync.Mutex
+}
+
+// NewP4Store creates a store submitting from the workspace rooted at dataDir.
+func NewP4Store(dataDir string, logger *logrus.Logger) *P4Store {
+	return &P4Store{dataDir: dataDir, logger: logger}
+}
+
+// Commit reconciles and submits the customer's directory.
+func (s *P4Store) Commit(customer, message string) (*Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	change, err := P4SyncIT(CurrentP4Client(), s.dataDir, customer, message, s.logger)
+	if err != nil || change == 0 {
+		return nil, err
+	}
+	return &Revision{ID: strconv.Itoa(change), Time: time.Now(), Description: message}, nil
+}
+
+// History lists the most recent changelists under the customer's directory.
+func (s *P4Store) History(customer string, max int) ([]Revision, error) {
+	customerDirPath := filepath.Join(s.dataDir, customer, "/...")
+	result, err := CurrentP4Client().RunTagged("", "changes", "-l", "-m", fmt.Sprint(max), customerDirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]Revision, 0, len(result.Records))
+	for _, record := range result.Records {
+		seconds, _ := strconv.ParseInt(record["time"], 10, 64)
+		revisions = append(revisions, Revision{
+			ID:          record["change"],
+			Time:        time.Unix(seconds, 0),
+			User:        record["user"],
+			Description: strings.SplitN(strings.TrimSpace(record["desc"]), "\n", 2)[0],
+		})
+	}
+	return revisions, nil
+}
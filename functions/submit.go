@@ -0,0 +1,176 @@
+package functions
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// defaultSubmitDescription is used when config.yaml has no submit_description, or when it
+// fails to execute.
+const defaultSubmitDescription = "Customer: {{.Customer}}, Instance: {{.Instance}}, monitoring submit{{if .Rerendered}}, rerendered from raw payloads{{end}}"
+
+var defaultSubmitTemplate = template.Must(parseSubmitDescription(""))
+
+// SubmitInfo describes a push whose changes are to be committed.
+type SubmitInfo struct {
+	Customer   string
+	Instance   string
+	User       string
+	ClientAddr string
+	// Files are the files rendered by the push; only changed ones are described.
+	Files []FileResult
+	// ChangedTags are the monitor tags whose items differ from the previous push, or nil if
+	// that is not known.
+	ChangedTags []string
+	// Rerendered is set when the files were rebuilt from raw payloads rather than pushed.
+	Rerendered bool
+
+	digests map[string]tagDigest
+}
+
+// SubmitContext is the data available to the submit_description template. A queued submit
+// may cover several pushes, so everything but Customer can list more than one value.
+type SubmitContext struct {
+	Customer string
+	// Instance, User and ClientAddr are the distinct values of Instances, Users and
+	// ClientAddrs joined with ", ".
+	Instance    string
+	Instances   []string
+	User        string
+	Users       []string
+	ClientAddr  string
+	ClientAddrs []string
+	// Files are the changed files, relative to the data directory.
+	Files []FileResult
+	// Tags are the monitor tags whose items changed, sorted. Where the previous items are not
+	// known they are the monitor tags of the changed files.
+	Tags []string
+	// Rerendered is set when the submit comes from the rerender command.
+	Rerendered bool
+}
+
+// clientAddr returns the address of the client that sent req, without the port.
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// newSubmitContext merges the pushes covered by one submit.
+func newSubmitContext(customer string, pushes []SubmitInfo) *SubmitContext {
+	ctx := &SubmitContext{Customer: customer}
+	files := make(map[string]int)
+	tags := make(map[string]bool)
+	for _, push := range pushes {
+		ctx.Rerendered = ctx.Rerendered || push.Rerendered
+		ctx.Instances = appendDistinct(ctx.Instances, push.Instance)
+		ctx.Users = appendDistinct(ctx.Users, push.User)
+		ctx.ClientAddrs = appendDistinct(ctx.ClientAddrs, push.ClientAddr)
+		for tag := range pushTags(push) {
+			tags[tag] = true
+		}
+		for _, file := range push.Files {
+			if !file.Changed {
+				continue
+			}
+			// A later push of the same file replaces the earlier one
+			if i, ok := files[file.Path]; ok {
+				ctx.Files[i] = file
+				continue
+			}
+			files[file.Path] = len(ctx.Files)
+			ctx.Files = append(ctx.Files, file)
+		}
+	}
+	sort.Strings(ctx.Instances)
+	sort.Slice(ctx.Files, func(i, j int) bool { return ctx.Files[i].Path < ctx.Files[j].Path })
+	for tag := range tags {
+		ctx.Tags = append(ctx.Tags, tag)
+	}
+	sort.Strings(ctx.Tags)
+	ctx.Instance = strings.Join(ctx.Instances, ", ")
+	ctx.User = strings.Join(ctx.Users, ", ")
+	ctx.ClientAddr = strings.Join(ctx.ClientAddrs, ", ")
+	return ctx
+}
+
+// pushTags returns the monitor tags a push changed, or those of its changed files if that is
+// not known.
+func pushTags(push SubmitInfo) map[string]bool {
+	tags := make(map[string]bool)
+	if push.ChangedTags != nil {
+		for _, tag := range push.ChangedTags {
+			tags[tag] = true
+		}
+		return tags
+	}
+	for _, file := range push.Files {
+		if file.Changed {
+			for _, tag := range file.MonitorTags {
+				tags[tag] = true
+			}
+		}
+	}
+	return tags
+}
+
+func appendDistinct(values []string, value string) []string {
+	if value == "" || contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
+
+// parseSubmitDescription parses the submit_description template, or the default one if value
+// is empty, and checks it against sample data.
+func parseSubmitDescription(value string) (*template.Template, error) {
+	if value == "" {
+		value = defaultSubmitDescription
+	}
+	tmpl, err := template.New("submit_description").Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %v", err)
+	}
+	sample := newSubmitContext("customer", []SubmitInfo{{
+		Customer:    "customer",
+		Instance:    "instance",
+		User:        "user",
+		ClientAddr:  "127.0.0.1",
+		Files:       []FileResult{{Path: "customer/servers/instance.md", Changed: true, MonitorTags: []string{"tag"}}},
+		ChangedTags: []string{"tag"},
+	}})
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, fmt.Errorf("error executing template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// submitDescription is the revision message recorded for the given pushes of a customer.
+func submitDescription(customer string, pushes []SubmitInfo) string {
+	ctx := newSubmitContext(customer, pushes)
+	if tmpl := CurrentSortConfig().submitTemplate; tmpl != nil {
+		description, err := executeSubmitDescription(tmpl, ctx)
+		if err != nil {
+			logger.Warnf("Error executing submit_description for customer %s: %v", customer, err)
+		} else if description != "" {
+			return description
+		}
+	}
+	description, _ := executeSubmitDescription(defaultSubmitTemplate, ctx)
+	return description
+}
+
+func executeSubmitDescription(tmpl *template.Template, ctx *SubmitContext) (string, error) {
+	var description bytes.Buffer
+	if err := tmpl.Execute(&description, ctx); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(description.String()), nil
+}
@@ -0,0 +1,106 @@
+package functions
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+)
+
+type tagDigest [sha256.Size]byte
+
+// lastTags holds, per customer and instance, a digest of each monitor tag's items in the last
+// committed push, to tell which tags the next push changes.
+var lastTags = struct {
+	sync.Mutex
+	instances map[string]map[string]tagDigest
+}{instances: make(map[string]map[string]tagDigest)}
+
+// digestTags returns a digest of the descriptions and output of each monitor tag's items. Lines
+// of output matching volatile_lines are left out, as they do not make a report change.
+func digestTags(items []Item) map[string]tagDigest {
+	volatile := CurrentSortConfig().volatile
+	content := make(map[string][]byte)
+	for _, item := range items {
+		data := append(content[item.MonitorTag], item.Description...)
+		data = append(data, 0)
+		data = append(data, stripVolatileLines([]byte(item.DecodedOutput()), volatile)...)
+		content[item.MonitorTag] = append(data, 0)
+	}
+	digests := make(map[string]tagDigest, len(content))
+	for tag, data := range content {
+		digests[tag] = sha256.Sum256(data)
+	}
+	return digests
+}
+
+// rawPayloadTags returns the tag digests of the instance's latest raw payload, or nil if none
+// is kept.
+func rawPayloadTags(dataDir, customer, instance string) map[string]tagDigest {
+	if !rawPayloads.enabled {
+		return nil
+	}
+	latest, err := LatestRawPayloads(dataDir, customer)
+	if err != nil || latest[instance] == "" {
+		return nil
+	}
+	body, err := readPayloadFile(latest[instance])
+	if err != nil {
+		return nil
+	}
+	items, invalid, err := ValidateItems(body)
+	if err != nil || len(invalid) > 0 {
+		return nil
+	}
+	return digestTags(items)
+}
+
+// changedTags returns the monitor tags whose items were added, changed or dropped since the
+// instance's last committed push, sorted, and the digests to record with recordTags once the
+// push is committed. The tags are nil when there is nothing to compare with, as for the first
+// push after a restart without raw payloads. It must be called with the customer lock held,
+// before the push's raw payload is saved.
+func changedTags(dataDir, customer, instance string, items []Item) ([]string, map[string]tagDigest) {
+	key := customer + "/" + instance
+	digests := digestTags(items)
+	lastTags.Lock()
+	previous, ok := lastTags.instances[key]
+	lastTags.Unlock()
+	if !ok {
+		// Seed from the payload kept before this push, so that retries of a push whose commit
+		// fails keep comparing with it rather than with their own earlier attempts
+		previous = rawPayloadTags(dataDir, customer, instance)
+		if previous != nil {
+			lastTags.Lock()
+			lastTags.instances[key] = previous
+			lastTags.Unlock()
+		}
+	}
+	if previous == nil {
+		return nil, digests
+	}
+
+	changed := []string{}
+	for tag, digest := range digests {
+		if old, ok := previous[tag]; !ok || old != digest {
+			changed = append(changed, tag)
+		}
+	}
+	for tag := range previous {
+		if _, ok := digests[tag]; !ok {
+			changed = append(changed, tag)
+		}
+	}
+	sort.Strings(changed)
+	return changed, digests
+}
+
+// recordTags records the digests of committed pushes as the base for the next comparison.
+func recordTags(pushes []SubmitInfo) {
+	lastTags.Lock()
+	defer lastTags.Unlock()
+	for _, push := range pushes {
+		if push.digests != nil {
+			lastTags.instances[push.Customer+"/"+push.Instance] = push.digests
+		}
+	}
+}
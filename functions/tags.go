@@ -0,0 +1,70 @@
+package functions
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexTagPrefix marks a monitor_tags entry as a regular expression.
+const regexTagPrefix = "re:"
+
+// compileMonitorTag turns a monitor_tags entry into a regular expression matching whole tags.
+// Entries are literal tags, globs using * and ?, or regular expressions prefixed with "re:".
+// All forms match case-insensitively.
+func compileMonitorTag(tag string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(tag, regexTagPrefix) {
+		re, err := regexp.Compile("(?i)^(?:" + strings.TrimPrefix(tag, regexTagPrefix) + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid monitor tag %q: %v", tag, err)
+		}
+		return re, nil
+	}
+
+	var pattern strings.Builder
+	pattern.WriteString("(?i)^")
+	for _, r := range tag {
+		switch r {
+		case '*':
+			pattern.WriteString(".*")
+		case '?':
+			pattern.WriteString(".")
+		default:
+			pattern.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	pattern.WriteString("$")
+	return regexp.Compile(pattern.String())
+}
+
+// compileMonitorTags compiles every monitor_tags entry of the file config.
+func (fc *FileConfig) compileMonitorTags() error {
+	fc.tagPatterns = make([]*regexp.Regexp, 0, len(fc.MonitorTags))
+	for _, tag := range fc.MonitorTags {
+		re, err := compileMonitorTag(tag)
+		if err != nil {
+			return err
+		}
+		fc.tagPatterns = append(fc.tagPatterns, re)
+	}
+	return nil
+}
+
+// tagIndex returns the position of the first monitor_tags entry matching tag, or -1 if none does.
+func (fc FileConfig) tagIndex(tag string) int {
+	if fc.tagPatterns == nil {
+		// Not loaded from a config file, so match the entries literally
+		for i, t := range fc.MonitorTags {
+			if strings.EqualFold(t, tag) {
+				return i
+			}
+		}
+		return -1
+	}
+	for i, re := range fc.tagPatterns {
+		if re.MatchString(tag) {
+			return i
+		}
+	}
+	return -1
+}
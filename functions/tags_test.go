@@ -0,0 +1,74 @@
+package functions
+
+import "testing"
+
+func TestCompileMonitorTag(t *testing.T) {
+	tests := []struct {
+		entry string
+		tag   string
+		want  bool
+	}{
+		{"p4 configure", "p4 configure", true},
+		{"p4 configure", "P4 Configure", true},
+		{"p4 configure", "p4 configure show", false},
+		{"p4 configure", "run p4 configure", false},
+		{"p4.info", "p4xinfo", false},
+		{"p4 *", "p4 info", true},
+		{"p4 *", "p4 ", true},
+		{"p4 *", "xp4 info", false},
+		{"p4 ?nfo", "p4 info", true},
+		{"p4 ?nfo", "p4 nfo", false},
+		{"*", "", true},
+		{"re:disk", "disk", true},
+		{"re:disk", "DISK", true},
+		{"re:disk", "diskio_extra", false},
+		{"re:disk", "iodisk", false},
+		{"re:disk.*", "diskio_extra", true},
+		{"re:^Autobot OS_.*", "Autobot OS_linux", true},
+		{"re:a|b", "a", true},
+		{"re:a|b", "ab", false},
+	}
+	for _, test := range tests {
+		re, err := compileMonitorTag(test.entry)
+		if err != nil {
+			t.Fatalf("compileMonitorTag(%q): %v", test.entry, err)
+		}
+		if got := re.MatchString(test.tag); got != test.want {
+			t.Errorf("compileMonitorTag(%q) matching %q = %v, want %v", test.entry, test.tag, got, test.want)
+		}
+	}
+}
+
+func TestCompileMonitorTagInvalid(t *testing.T) {
+	if _, err := compileMonitorTag("re:("); err == nil {
+		t.Error("compileMonitorTag(\"re:(\") succeeded, want an error")
+	}
+}
+
+func TestTagIndex(t *testing.T) {
+	fc := FileConfig{MonitorTags: []string{"p4 info", "p4 *", "re:disk.*"}}
+	if err := fc.compileMonitorTags(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		tag  string
+		want int
+	}{
+		{"p4 info", 0},
+		{"P4 INFO", 0},
+		{"p4 configure", 1},
+		{"diskio", 2},
+		{"uptime", -1},
+	}
+	for _, test := range tests {
+		if got := fc.tagIndex(test.tag); got != test.want {
+			t.Errorf("tagIndex(%q) = %d, want %d", test.tag, got, test.want)
+		}
+	}
+
+	// Entries not loaded from a config file are matched literally
+	literal := FileConfig{MonitorTags: []string{"p4 *"}}
+	if got := literal.tagIndex("p4 info"); got != -1 {
+		t.Errorf("tagIndex without compiled patterns = %d, want -1", got)
+	}
+}
@@ -0,0 +1,110 @@
+package functions
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertReloader serves a TLS certificate/key pair from disk and reloads it when either file changes,
+// so certificates can be rotated without restarting the gateway.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	logger   *logrus.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// NewCertReloader loads the initial certificate and returns a reloader for it.
+func NewCertReloader(certFile, keyFile string, logger *logrus.Logger) (*CertReloader, error) {
+	cr := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// load reads the certificate and key from disk and swaps them in.
+func (cr *CertReloader) load() error {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate %s/%s: %v", cr.certFile, cr.keyFile, err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.certMod = certMod
+	cr.keyMod = keyMod
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error reading TLS certificate %s: %v", cr.certFile, err)
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("error reading TLS key %s: %v", cr.keyFile, err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// reloadIfChanged reloads the certificate if the modification time of either file has changed.
+// A failed reload keeps the previous certificate in service.
+func (cr *CertReloader) reloadIfChanged() {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		cr.logger.Errorf("TLS certificate check failed, keeping current certificate: %v", err)
+		return
+	}
+	cr.mu.RLock()
+	changed := !certMod.Equal(cr.certMod) || !keyMod.Equal(cr.keyMod)
+	cr.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err := cr.load(); err != nil {
+		cr.logger.Errorf("TLS certificate reload failed, keeping current certificate: %v", err)
+		return
+	}
+	cr.logger.Infof("Reloaded TLS certificate %s", cr.certFile)
+}
+
+// Watch polls the certificate and key files every interval until stop is closed.
+// A nil stop channel watches for the lifetime of the process. interval must be positive.
+func (cr *CertReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cr.reloadIfChanged()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// GetCertificate is suitable for use as tls.Config.GetCertificate.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
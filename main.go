@@ -9,11 +9,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"datapushgateway/functions"
 
 	"github.com/perforce/p4prometheus/version"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -49,11 +53,95 @@ func main() {
 			"data",
 			"Directory where to store uploaded data.",
 		).Short('d').Default("data").String()
+		tlsCert = kingpin.Flag(
+			"tls.cert",
+			"TLS certificate file. When set together with --tls.key the gateway serves HTTPS.",
+		).String()
+		tlsKey = kingpin.Flag(
+			"tls.key",
+			"TLS private key file. When set together with --tls.cert the gateway serves HTTPS.",
+		).String()
+		tlsReloadInterval = kingpin.Flag(
+			"tls.reload-interval",
+			"How often to check the TLS certificate and key files for changes, 0 to disable.",
+		).Default("1m").Duration()
+		tlsClientCA = kingpin.Flag(
+			"tls.client-ca",
+			"CA bundle used to verify client certificates. Verified certificates mapped in client_cert_users are accepted in place of basic auth.",
+		).String()
+		tlsClientCertRequired = kingpin.Flag(
+			"tls.client-cert-required",
+			"Reject TLS connections that do not present a valid client certificate.",
+		).Bool()
+		submitAsync = kingpin.Flag(
+			"submit.async",
+			"Acknowledge pushes once written to disk and submit to Perforce from a background queue.",
+		).Bool()
+		submitRetries = kingpin.Flag(
+			"submit.retries",
+			"Number of times a failed queued submit is retried.",
+		).Default("5").Int()
+		submitRetryBackoff = kingpin.Flag(
+			"submit.retry-backoff",
+			"Delay before the first retry of a failed queued submit; doubled on each further retry.",
+		).Default("30s").Duration()
+		submitBatchDelay = kingpin.Flag(
+			"submit.batch-delay",
+			"How long a queued submit waits for further pushes from the same customer before running.",
+		).Default("0s").Duration()
+		storageType = kingpin.Flag(
+			"storage",
+			"Storage backend, overriding storage.type in the config file: p4, git or filesystem.",
+		).Enum(functions.StorageP4, functions.StorageGit, functions.StorageFilesystem)
+		lockTimeout = kingpin.Flag(
+			"lock.timeout",
+			"How long a push waits for another push to the same customer to finish before returning 503.",
+		).Default("30s").Duration()
+		p4LoginCheckInterval = kingpin.Flag(
+			"p4.login-check-interval",
+			"How often to check the Perforce ticket and log in again if needed, 0 to check only at startup.",
+		).Default("10m").Duration()
+		p4RefreshBefore = kingpin.Flag(
+			"p4.refresh-before",
+			"Refresh the Perforce ticket when it expires within this time.",
+		).Default("1h").Duration()
+		rawStore = kingpin.Flag(
+			"raw.store",
+			"Keep each accepted /json/ payload under <data>/<customer>/raw/<instance>/ so that reports can be rebuilt with rerender.",
+		).Bool()
+		rawGzip = kingpin.Flag(
+			"raw.gzip",
+			"Gzip compress kept /json/ payloads.",
+		).Bool()
+		rawRetain = kingpin.Flag(
+			"raw.retain",
+			"Number of kept /json/ payloads per instance; older ones are removed. 0 keeps all.",
+		).Default("0").Int()
+
+		serveCmd       = kingpin.Command("serve", "Run the gateway (default).").Default()
+		checkConfigCmd = kingpin.Command("check-config", "Check the config file for problems, exiting non-zero if any are found.")
+		checkTagsFile  = checkConfigCmd.Flag(
+			"tags",
+			"File listing the monitor tags clients send, one per line. Configured tags not listed are reported.",
+		).String()
+		renderCmd      = kingpin.Command("render", "Render a saved /json/ payload locally with the config file, without HTTP or Perforce.")
+		renderCustomer = renderCmd.Flag("customer", "Customer the payload is rendered for.").Required().String()
+		renderInstance = renderCmd.Flag("instance", "Instance the payload is rendered for.").Required().String()
+		renderUser     = renderCmd.Flag("user", "User substituted for %USER% in file_name and directory.").String()
+		renderInput    = renderCmd.Flag("input", "JSON payload file, as pushed to /json/.").Required().ExistingFile()
+		renderOut      = renderCmd.Flag("out", "Directory to render into.").Default("render").String()
+		renderDiff     = renderCmd.Flag(
+			"diff",
+			"Existing data directory to diff the rendered files against.",
+		).ExistingDir()
+		rerenderCmd      = kingpin.Command("rerender", "Rebuild a customer's files from the latest kept /json/ payloads with the current config file, and commit them.")
+		rerenderCustomer = rerenderCmd.Flag("customer", "Customer to rebuild.").Required().String()
+		rerenderUser     = rerenderCmd.Flag("user", "User substituted for %USER% in file_name and directory.").String()
 	)
 
 	kingpin.Version(version.Print("datapushgateway"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	// Create the logger after parsing the debug flag
 	logger = logrus.New()
@@ -64,6 +152,18 @@ func main() {
 		logger.Level = logrus.InfoLevel
 	}
 	functions.SetDebugMode(*debug)
+	functions.SetLockTimeout(*lockTimeout)
+	functions.SetStorageType(*storageType)
+	functions.SetRawPayloads(*rawStore, *rawGzip, *rawRetain)
+
+	switch command {
+	case checkConfigCmd.FullCommand():
+		os.Exit(checkConfig(*configFile, *dataDir, *checkTagsFile))
+	case renderCmd.FullCommand():
+		os.Exit(renderPayload(*configFile, *renderInput, *renderOut, *renderDiff, *renderCustomer, *renderInstance, *renderUser))
+	case serveCmd.FullCommand():
+		// Carry on below and run the gateway
+	}
 
 	config, err := functions.LoadConfig(*configFile)
 	if err != nil {
@@ -74,12 +174,54 @@ func main() {
 	if err != nil {
 		logger.Fatal(err)
 	}
-	// Ensure Perforce login
-	if !functions.HasValidTicket(logger) {
-		if err := functions.P4Login(logger); err != nil {
-			logger.Fatalf("Failed to log in to Perforce: %v", err)
+	// All p4 commands go through one client configured from config.yaml
+	// and replaced when a reload changes applicationConfig
+	functions.SetP4Client(functions.NewP4Client(config.ApplicationConfig, logger))
+
+	// Ensure Perforce login, prompting only when run from a terminal. If that fails the
+	// gateway still starts, but /-/healthy reports the problem until a background check succeeds.
+	var p4Auth *functions.P4Auth
+	if config.Storage.Type == functions.StorageP4 {
+		p4Auth = functions.NewP4Auth(*p4RefreshBefore, logger)
+		if err := p4Auth.Check(); err != nil {
+			logger.Warnf("Perforce login: %v", err)
+			if err := p4Auth.Prompt(); err != nil {
+				logger.Errorf("Not logged in to Perforce, submits will fail: %v", err)
+			}
+		}
+		if *p4LoginCheckInterval > 0 {
+			go p4Auth.Watch(*p4LoginCheckInterval, nil)
+		} else {
+			logger.Info("Background Perforce login checks disabled")
+		}
+	}
+	store, err := functions.NewStore(config, *dataDir, logger)
+	if err != nil {
+		logger.Fatalf("Error setting up %s storage: %v", config.Storage.Type, err)
+	}
+	logger.Infof("Using %s storage", config.Storage.Type)
+
+	if command == rerenderCmd.FullCommand() {
+		os.Exit(rerender(store, *dataDir, *rerenderCustomer, *rerenderUser))
+	}
+
+	// Reload auth and config files on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := functions.Reload(*authFile, *configFile, logger); err != nil {
+				logger.Errorf("Reload failed, keeping current configuration: %v", err)
+			}
 		}
+	}()
+
+	var queue *functions.SubmitQueue
+	if *submitAsync {
+		queue = functions.NewSubmitQueue(store, *submitRetries, *submitRetryBackoff, *submitBatchDelay, logger)
+		go queue.Run()
 	}
+
 	mux := http.NewServeMux()
 
 	// Middleware for logging connection details
@@ -103,29 +245,48 @@ func main() {
 		fmt.Fprintf(w, "Data PushGateway\n")
 	}))
 
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, req *http.Request) {
+		functions.HandleHealth(w, req, p4Auth)
+	})
+
+	mux.HandleFunc("/-/reload", ConnectionLoggingMiddleware(func(w http.ResponseWriter, req *http.Request) {
+		functions.HandleReload(w, req, logger, *authFile, *configFile)
+	}))
+
+	mux.HandleFunc("/history/", ConnectionLoggingMiddleware(func(w http.ResponseWriter, req *http.Request) {
+		functions.HandleHistory(w, req, logger, store)
+	}))
+
 	mux.HandleFunc("/json/", ConnectionLoggingMiddleware(func(w http.ResponseWriter, req *http.Request) {
-		customer, instance, err := functions.HandleHTTP(w, req, logger, *dataDir)
+		customer, instance, user, err := functions.HandleHTTP(w, req, logger, *dataDir)
 		if err != nil {
 			return
 		}
-		functions.HandleJSONData(w, req, logger, *configFile, *dataDir, customer, instance)
+		functions.HandleJSONData(w, req, logger, *dataDir, customer, instance, user, store, queue)
 	}))
 
 	mux.HandleFunc("/data/", ConnectionLoggingMiddleware(func(w http.ResponseWriter, req *http.Request) {
-		var validName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
-
-		user, pass, ok := req.BasicAuth()
-		if ok && functions.VerifyUserPass(user, pass) {
-			logger.Debugf("Basic auth verified for user: %s", user)
+		start := time.Now()
+		user, ok := functions.Authenticate(req)
+		if ok {
+			logger.Debugf("Authenticated user: %s", user)
 			query := req.URL.Query()
 			customer := query.Get("customer")
 			instance := query.Get("instance")
 
 			// Validate the customer and instance parameters
-			if customer == "" || instance == "" || !validName.MatchString(customer) || !validName.MatchString(instance) {
+			if !functions.ValidName(customer) || !functions.ValidName(instance) {
 				http.Error(w, "Invalid or missing customer or instance name", http.StatusBadRequest)
 				return
 			}
+			if !functions.Authorize(user, customer, instance) {
+				logger.Warnf("User %s is not authorized for customer: %s, instance: %s", user, customer, instance)
+				functions.RecordAuthFailure("data")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
 
 			// Read the body of the request
 			body, err := io.ReadAll(req.Body)
@@ -135,27 +296,34 @@ func main() {
 				return
 			}
 			logger.Debugf("Request Body: %s", string(body))
+			functions.RecordPush("data", customer, instance, len(body))
+
+			// Hold the customer lock while writing and submitting
+			resp := functions.NewPushResponse(req, customer, instance, user, start)
+			unlock, ok := functions.LockCustomer(customer)
+			if !ok {
+				logger.Warnf("Timed out waiting for lock on customer: %s", customer)
+				functions.RespondBusy(w, customer)
+				return
+			}
+			defer unlock()
+			resp.Locked()
 
 			// Save the data received to the filesystem
 			logger.Debugf("Saving data to dataDir: %s, customer: %s", *dataDir, customer)
-			err = functions.SaveData(*dataDir, customer, instance, string(body), logger)
+			file, err := functions.SaveData(store, *dataDir, customer, instance, string(body), logger)
 			if err != nil {
 				logger.Errorf("Error saving data: %v", err)
 				http.Error(w, "Failed to save data", http.StatusInternalServerError)
 				return
 			}
-			w.Write([]byte("Data saved"))
+			resp.Rendered([]functions.FileResult{file})
 
-			// Synchronize the saved data with Perforce
-			err = functions.P4SyncIT(config.ApplicationConfig.P4Bin, *dataDir, customer, instance, logger)
-			if err != nil {
-				logger.Errorf("P4SyncIT error: %v", err)
-				http.Error(w, "Error syncing data with Perforce", http.StatusInternalServerError)
-				return
-			}
-			w.Write([]byte("Data synced with Perforce"))
+			// Record the saved data in the store
+			functions.FinishPush(w, store, queue, resp, logger)
 		} else {
 			// Prompt for basic auth if verification fails
+			functions.RecordAuthFailure("data")
 			w.Header().Set("WWW-Authenticate", `Basic realm="api"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		}
@@ -170,8 +338,46 @@ func main() {
 		},
 	}
 
-	logger.Infof("Starting server on %s", *port)
-	err = srv.ListenAndServe()
+	if (*tlsCert == "") != (*tlsKey == "") {
+		logger.Fatal("Both --tls.cert and --tls.key must be specified to enable TLS")
+	}
+	if *tlsCert == "" && (*tlsClientCA != "" || *tlsClientCertRequired) {
+		logger.Fatal("Client certificate authentication requires --tls.cert and --tls.key")
+	}
+	if *tlsClientCertRequired && *tlsClientCA == "" {
+		logger.Fatal("--tls.client-cert-required requires --tls.client-ca")
+	}
+	if *tlsCert != "" {
+		reloader, err := functions.NewCertReloader(*tlsCert, *tlsKey, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if *tlsReloadInterval > 0 {
+			go reloader.Watch(*tlsReloadInterval, nil)
+		} else {
+			logger.Info("TLS certificate reloading disabled")
+		}
+		srv.TLSConfig.GetCertificate = reloader.GetCertificate
+
+		if *tlsClientCA != "" {
+			pool, err := functions.LoadClientCAs(*tlsClientCA)
+			if err != nil {
+				logger.Fatal(err)
+			}
+			srv.TLSConfig.ClientCAs = pool
+			if *tlsClientCertRequired {
+				srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			} else {
+				srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+
+		logger.Infof("Starting TLS server on %s", *port)
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		logger.Infof("Starting server on %s", *port)
+		err = srv.ListenAndServe()
+	}
 	if err != nil {
 		logger.Fatal(err)
 	}